@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/auth"
 	"github.com/dkrasnykh/metrics-alerter/internal/config"
 	"github.com/dkrasnykh/metrics-alerter/internal/logger"
 	"github.com/dkrasnykh/metrics-alerter/internal/server"
+	"github.com/dkrasnykh/metrics-alerter/internal/storage"
+	"github.com/dkrasnykh/metrics-alerter/internal/storage/database"
 )
 
 func main() {
@@ -15,6 +22,28 @@ func main() {
 	if err != nil {
 		logger.Fatal(err.Error())
 	}
+	if cfg.PrintMigrations {
+		err = database.PrintPending(context.Background(), cfg.DatabaseDSN, os.Stdout)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		return
+	}
+	if cfg.IssueAdminToken {
+		tokens, err := storage.NewTokens(cfg, nil)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		if tokens == nil {
+			logger.Fatal("token store is not configured")
+		}
+		secret, _, err := auth.Issue(context.Background(), tokens, []string{auth.ScopeAdmin}, "")
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		fmt.Println(secret)
+		return
+	}
 	s := server.New(cfg)
 	err = s.Run()
 	if err != nil {
@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/hmac"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"runtime"
 	"strconv"
@@ -21,8 +24,10 @@ import (
 
 	"github.com/dkrasnykh/metrics-alerter/internal/config"
 	"github.com/dkrasnykh/metrics-alerter/internal/hash"
+	"github.com/dkrasnykh/metrics-alerter/internal/idempotency"
 	"github.com/dkrasnykh/metrics-alerter/internal/logger"
 	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/tenant"
 )
 
 type SyncMemStats struct {
@@ -42,8 +47,16 @@ type Agent struct {
 	reportTicker   *time.Ticker
 	pollCount      int64
 	key            string
+	keyID          string
+	tenant         string
+	token          string
+	agentID        string
+	epoch          int64
 	rateLimit      int
+	realIP         string
 	memStats       SyncMemStats
+	described      time.Time
+	describedMx    sync.Mutex
 }
 
 func New(c *config.AgentConfig) *Agent {
@@ -53,7 +66,13 @@ func New(c *config.AgentConfig) *Agent {
 		pollInterval:   c.PollInterval,
 		reportInterval: c.ReportInterval,
 		key:            c.Key,
+		keyID:          c.KeyID,
+		tenant:         c.Tenant,
+		token:          c.Token,
+		agentID:        c.AgentID,
+		epoch:          time.Now().Unix(),
 		rateLimit:      c.RateLimit,
+		realIP:         outboundIP(c.Address),
 		memStats: SyncMemStats{
 			v:  &runtime.MemStats{},
 			mx: sync.RWMutex{},
@@ -108,6 +127,7 @@ func (a *Agent) worker(ctx context.Context, jobs <-chan []models.Metrics, result
 			if !ok {
 				results <- struct{}{}
 			}
+			a.describe()
 			a.sendBatchRequest(job)
 		case <-ctx.Done():
 			results <- struct{}{}
@@ -122,7 +142,7 @@ func (a *Agent) reportMemStats(jobs chan []models.Metrics) {
 
 		a.memStats.mx.RLock()
 		metrics := []models.Metrics{
-			{ID: `PollCount`, MType: models.CounterType, Delta: &a.pollCount},
+			{ID: `PollCount`, MType: models.CounterType, Kind: models.CumulativeKind, Delta: &a.pollCount},
 			{ID: `RandomValue`, MType: models.GaugeType, Value: &f},
 			{ID: `Alloc`, MType: models.GaugeType, Value: a.parse(a.memStats.v.Alloc)},
 			{ID: `BuckHashSys`, MType: models.GaugeType, Value: a.parse(a.memStats.v.BuckHashSys)},
@@ -168,30 +188,113 @@ func (a *Agent) parse(v uint64) *float64 {
 }
 
 func (a *Agent) sendBatchRequest(metrics []models.Metrics) {
-	req := a.client.R().SetHeader(headers.ContentType, `application/json`).
-		SetHeader(headers.ContentEncoding, `gzip`).
-		SetHeader(headers.AcceptEncoding, `gzip`)
 	buf := gzipData(metrics)
-	if a.key != "" {
-		req.SetHeader(hash.Header, hash.Encode(buf, []byte(a.key)))
-	}
-	req.SetBody(buf)
+	key := idempotency.NewKey()
 
 	var resp *resty.Response
 	err := retry.Do(
 		func() error {
 			var err error
-			resp, err = req.Post(fmt.Sprintf("http://%s/updates/", a.serverAddress))
-			return err
+			resp, err = a.request(buf, key).Post(fmt.Sprintf("http://%s/updates/", a.serverAddress))
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode() == http.StatusTooManyRequests {
+				return config.NewRetryAfterError(resp.StatusCode(), resp.Header().Get(headers.RetryAfter))
+			}
+			return nil
 		},
 		retry.Attempts(config.Attempts),
 		retry.DelayType(config.DelayType),
 		retry.OnRetry(config.OnRetry),
 	)
-	logger.LogErrorIfNotNil(err)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
 	if resp.StatusCode() != http.StatusOK {
-		logger.Error(fmt.Sprintf(`unexpected status code %d`, resp.StatusCode()))
+		logger.Error(fmt.Sprintf(`unexpected status code %d: %s`, resp.StatusCode(), resp.String()))
+		return
+	}
+	err = a.verify(resp)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	var report models.BatchReport
+	err = json.Unmarshal(resp.Body(), &report)
+	if err != nil {
+		logger.Error(fmt.Sprintf("error parsing batch report: %s", err.Error()))
+		return
+	}
+	for _, r := range report.Rejected {
+		logger.Error(fmt.Sprintf("metric %s (#%d) rejected: %s", r.ID, r.Index, r.Reason))
+	}
+}
+
+// request is built anew for every attempt, since a signed request carries a
+// nonce the server accepts only once. The idempotency key stays the same
+// across attempts, so a batch whose response was lost is not applied twice.
+func (a *Agent) request(buf []byte, key string) *resty.Request {
+	req := a.client.R().SetHeader(headers.ContentType, `application/json`).
+		SetHeader(headers.ContentEncoding, `gzip`).
+		SetHeader(headers.AcceptEncoding, `gzip`).
+		SetHeader(idempotency.Header, key).
+		SetHeader(models.PartialHeader, "true")
+	if a.key != "" {
+		req.SetHeaders(hash.Headers(buf, []byte(a.key)))
+		if a.keyID != "" {
+			req.SetHeader(hash.KeyID, a.keyID)
+		}
+	}
+	if a.realIP != "" {
+		req.SetHeader(headers.XRealIP, a.realIP)
+	}
+	if a.tenant != "" {
+		req.SetHeader(tenant.Header, a.tenant)
+	}
+	if a.agentID != "" {
+		req.SetHeader(models.AgentHeader, a.agentID)
+	}
+	req.SetHeader(models.EpochHeader, strconv.FormatInt(a.epoch, 10))
+	if a.token != "" {
+		req.SetAuthToken(a.token)
+	}
+	return req.SetBody(buf)
+}
+
+// verify checks the server's signature on the response. A response that
+// names a key other than the agent's cannot be checked and is refused, as
+// the key ID is no more trustworthy than the rest of the response.
+func (a *Agent) verify(resp *resty.Response) error {
+	if a.key == "" {
+		return nil
+	}
+	if id := resp.Header().Get(hash.KeyID); id != a.keyID {
+		return fmt.Errorf("server response signed with key %q, expected %q", id, a.keyID)
+	}
+	signature := resp.Header().Get(hash.Header)
+	if signature == "" {
+		return errors.New("server response is not signed")
+	}
+	if !hmac.Equal([]byte(signature), []byte(hash.Encode(resp.Body(), []byte(a.key)))) {
+		return errors.New("server response signature mismatch")
+	}
+	return nil
+}
+
+// outboundIP returns the address of the interface the agent reaches the
+// server through; dialing UDP picks the route without sending anything.
+func outboundIP(server string) string {
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		logger.Error(err.Error())
+		return ""
 	}
+	defer func() {
+		logger.LogErrorIfNotNil(conn.Close())
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
 }
 
 func gzipData(any interface{}) []byte {
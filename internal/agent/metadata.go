@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/idempotency"
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+	"github.com/dkrasnykh/metrics-alerter/internal/metadata"
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+)
+
+// describeInterval is how often the agent sends its metadata again, so that
+// a restarted server learns it anew.
+const describeInterval = 10 * time.Minute
+
+func gauge(name, unit, description string) metadata.Meta {
+	return metadata.Meta{Name: name, Type: models.GaugeType, Unit: unit, Description: description}
+}
+
+var metas = []metadata.Meta{
+	{Name: `PollCount`, Type: models.CounterType, Description: "times the agent collected metrics"},
+	gauge(`RandomValue`, "", "random value in [0, 1)"),
+	gauge(`Alloc`, "bytes", "bytes of allocated heap objects"),
+	gauge(`BuckHashSys`, "bytes", "memory in profiling bucket hash tables"),
+	gauge(`Frees`, "", "cumulative count of heap objects freed"),
+	gauge(`GCCPUFraction`, "ratio", "fraction of CPU time used by the GC since start"),
+	gauge(`GCSys`, "bytes", "memory in garbage collection metadata"),
+	gauge(`HeapAlloc`, "bytes", "bytes of allocated heap objects"),
+	gauge(`HeapIdle`, "bytes", "bytes in idle heap spans"),
+	gauge(`HeapInuse`, "bytes", "bytes in in-use heap spans"),
+	gauge(`HeapObjects`, "", "number of allocated heap objects"),
+	gauge(`HeapReleased`, "bytes", "bytes of physical memory returned to the OS"),
+	gauge(`HeapSys`, "bytes", "bytes of heap memory obtained from the OS"),
+	gauge(`LastGC`, "nanoseconds", "time the last GC finished, since the Unix epoch"),
+	gauge(`Lookups`, "", "number of pointer lookups by the runtime"),
+	gauge(`MCacheInuse`, "bytes", "bytes of allocated mcache structures"),
+	gauge(`MCacheSys`, "bytes", "bytes of memory obtained from the OS for mcache structures"),
+	gauge(`MSpanInuse`, "bytes", "bytes of allocated mspan structures"),
+	gauge(`MSpanSys`, "bytes", "bytes of memory obtained from the OS for mspan structures"),
+	gauge(`Mallocs`, "", "cumulative count of heap objects allocated"),
+	gauge(`NextGC`, "bytes", "target heap size of the next GC cycle"),
+	gauge(`NumForcedGC`, "", "number of GC cycles forced by the application"),
+	gauge(`NumGC`, "", "number of completed GC cycles"),
+	gauge(`OtherSys`, "bytes", "memory in miscellaneous off-heap runtime allocations"),
+	gauge(`PauseTotalNs`, "nanoseconds", "cumulative time spent in GC stop-the-world pauses"),
+	gauge(`StackInuse`, "bytes", "bytes in stack spans"),
+	gauge(`StackSys`, "bytes", "bytes of stack memory obtained from the OS"),
+	gauge(`Sys`, "bytes", "total bytes of memory obtained from the OS"),
+	gauge(`TotalAlloc`, "bytes", "cumulative bytes allocated for heap objects"),
+	gauge(`TotalMemory`, "bytes", "total virtual memory of the host"),
+	gauge(`FreeMemory`, "bytes", "free virtual memory of the host"),
+	gauge(`CPUutilization1`, "percent", "CPU utilization of the host"),
+}
+
+// describe sends the metadata of the agent's metrics unless it was sent
+// within describeInterval; only a failure the server may recover from is
+// retried sooner.
+func (a *Agent) describe() {
+	a.describedMx.Lock()
+	defer a.describedMx.Unlock()
+
+	if time.Since(a.described) < describeInterval {
+		return
+	}
+	resp, err := a.request(gzipData(metas), idempotency.NewKey()).
+		Post(fmt.Sprintf("http://%s/metadata/", a.serverAddress))
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	if resp.StatusCode() != http.StatusOK {
+		logger.Error(fmt.Sprintf(`describing metrics: unexpected status code %d: %s`, resp.StatusCode(), resp.String()))
+	}
+	if resp.StatusCode() < http.StatusInternalServerError {
+		a.described = time.Now()
+	}
+}
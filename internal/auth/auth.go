@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+var ErrNotFound = errors.New("token not found")
+
+// Token is an issued API token; only the hash of its secret is ever stored.
+type Token struct {
+	ID      string    `json:"id"`
+	Hash    string    `json:"hash,omitempty"`
+	Scopes  []string  `json:"scopes"`
+	Tenant  string    `json:"tenant,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type Store interface {
+	Find(ctx context.Context, hash string) (Token, error)
+	Save(ctx context.Context, t Token) error
+	Revoke(ctx context.Context, id string) error
+	List(ctx context.Context) ([]Token, error)
+}
+
+type ctxKey struct{}
+
+// Allows reports whether the token grants the scope; admin grants every scope.
+func (t Token) Allows(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue stores a new token and returns its secret, which cannot be recovered
+// later.
+func Issue(ctx context.Context, s Store, scopes []string, tenant string) (string, Token, error) {
+	if len(scopes) == 0 {
+		return "", Token{}, errors.New("token has no scopes")
+	}
+	for _, scope := range scopes {
+		if scope != ScopeRead && scope != ScopeWrite && scope != ScopeAdmin {
+			return "", Token{}, fmt.Errorf("unknown scope %s", scope)
+		}
+	}
+	id, err := random(8)
+	if err != nil {
+		return "", Token{}, err
+	}
+	secret, err := random(32)
+	if err != nil {
+		return "", Token{}, err
+	}
+	t := Token{
+		ID:      id,
+		Hash:    Hash(secret),
+		Scopes:  scopes,
+		Tenant:  tenant,
+		Created: time.Now().UTC(),
+	}
+	err = s.Save(ctx, t)
+	if err != nil {
+		return "", Token{}, err
+	}
+	return secret, t, nil
+}
+
+func NewContext(ctx context.Context, t Token) context.Context {
+	return context.WithValue(ctx, ctxKey{}, t)
+}
+
+func FromContext(ctx context.Context) (Token, bool) {
+	t, ok := ctx.Value(ctxKey{}).(Token)
+	return t, ok
+}
+
+func random(n int) (string, error) {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
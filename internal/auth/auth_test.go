@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	s, err := NewFileStore(path)
+	require.NoError(t, err)
+
+	secret, issued, err := Issue(ctx, s, []string{ScopeRead}, "a")
+	require.NoError(t, err)
+	assert.NotContains(t, issued.Hash, secret)
+
+	s, err = NewFileStore(path)
+	require.NoError(t, err)
+	found, err := s.Find(ctx, Hash(secret))
+	require.NoError(t, err)
+	assert.Equal(t, issued.ID, found.ID)
+	assert.Equal(t, "a", found.Tenant)
+	assert.True(t, found.Allows(ScopeRead))
+	assert.False(t, found.Allows(ScopeWrite))
+
+	require.NoError(t, s.Revoke(ctx, issued.ID))
+	_, err = s.Find(ctx, Hash(secret))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, s.Revoke(ctx, issued.ID), ErrNotFound)
+}
+
+func TestIssue(t *testing.T) {
+	s, err := NewFileStore(filepath.Join(t.TempDir(), "tokens.json"))
+	require.NoError(t, err)
+
+	_, _, err = Issue(context.Background(), s, nil, "")
+	assert.Error(t, err)
+	_, _, err = Issue(context.Background(), s, []string{"root"}, "")
+	assert.Error(t, err)
+
+	_, admin, err := Issue(context.Background(), s, []string{ScopeAdmin}, "")
+	require.NoError(t, err)
+	assert.True(t, admin.Allows(ScopeRead))
+	assert.True(t, admin.Allows(ScopeWrite))
+}
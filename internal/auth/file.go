@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+type FileStore struct {
+	path   string
+	tokens []Token
+	mx     sync.RWMutex
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path}
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading tokens from file %s: %w", path, err)
+	}
+	err = json.Unmarshal(buf, &s.tokens)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing tokens file %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *FileStore) Find(_ context.Context, hash string) (Token, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	for _, t := range s.tokens {
+		if t.Hash == hash {
+			return t, nil
+		}
+	}
+	return Token{}, ErrNotFound
+}
+
+func (s *FileStore) Save(_ context.Context, t Token) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.write(append(s.tokens, t))
+}
+
+func (s *FileStore) Revoke(_ context.Context, id string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for i, t := range s.tokens {
+		if t.ID == id {
+			tokens := append(append([]Token{}, s.tokens[:i]...), s.tokens[i+1:]...)
+			return s.write(tokens)
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *FileStore) List(_ context.Context) ([]Token, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	return append([]Token{}, s.tokens...), nil
+}
+
+// write replaces the file atomically and only then the in-memory copy, so a
+// failed write leaves both unchanged.
+func (s *FileStore) write(tokens []Token) error {
+	buf, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".new"
+	err = os.WriteFile(tmp, buf, 0600)
+	if err != nil {
+		return fmt.Errorf("error writing tokens into file %s: %w", tmp, err)
+	}
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		return err
+	}
+	s.tokens = tokens
+	return nil
+}
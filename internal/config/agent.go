@@ -2,6 +2,7 @@ package config
 
 import (
 	"flag"
+	"os"
 
 	"github.com/caarlos0/env/v10"
 )
@@ -11,16 +12,25 @@ type AgentConfig struct {
 	ReportInterval int    `env:"REPORT_INTERVAL"`
 	PollInterval   int    `env:"POLL_INTERVAL"`
 	Key            string `env:"KEY"`
+	KeyID          string `env:"KEY_ID"`
 	RateLimit      int    `env:"RATE_LIMIT"`
+	Tenant         string `env:"TENANT"`
+	Token          string `env:"TOKEN"`
+	AgentID        string `env:"AGENT_ID"`
 }
 
 func NewAgentConfig() (*AgentConfig, error) {
 	var c AgentConfig
+	hostname, _ := os.Hostname()
 	flag.StringVar(&c.Address, "a", ":8080", "address and port for server connection")
 	flag.IntVar(&c.ReportInterval, "r", 10, "frequency of sending metrics to the server")
 	flag.IntVar(&c.PollInterval, "p", 2, "frequency of collecting metrics from runtime package")
 	flag.StringVar(&c.Key, "k", "", "hashing key")
+	flag.StringVar(&c.KeyID, "key-id", "", "ID of the hashing key on the server")
 	flag.IntVar(&c.RateLimit, "l", 1, "rate limit")
+	flag.StringVar(&c.Tenant, "tenant", "", "tenant the metrics are reported for")
+	flag.StringVar(&c.Token, "token", "", "tenant API token")
+	flag.StringVar(&c.AgentID, "agent-id", hostname, "unique name the server tracks cumulative counters of this agent by; keep it across restarts")
 	flag.Parse()
 
 	err := env.Parse(&c)
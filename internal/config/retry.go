@@ -1,7 +1,10 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/avast/retry-go"
@@ -11,7 +14,34 @@ import (
 
 const Attempts uint = 3
 
-func DelayType(n uint, _ error, config *retry.Config) time.Duration {
+// RetryAfterError is returned for a response asking the client to come back
+// later; DelayType then waits as long as the server asked.
+type RetryAfterError struct {
+	StatusCode int
+	After      time.Duration
+}
+
+// NewRetryAfterError parses the Retry-After header, given either in seconds
+// or as an HTTP date.
+func NewRetryAfterError(statusCode int, header string) *RetryAfterError {
+	e := &RetryAfterError{StatusCode: statusCode}
+	if sec, err := strconv.Atoi(header); err == nil {
+		e.After = time.Duration(sec) * time.Second
+	} else if t, err := http.ParseTime(header); err == nil {
+		e.After = time.Until(t)
+	}
+	return e
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("unexpected status code %d, retry after %s", e.StatusCode, e.After)
+}
+
+func DelayType(n uint, err error, config *retry.Config) time.Duration {
+	var retryAfter *RetryAfterError
+	if errors.As(err, &retryAfter) && retryAfter.After > 0 {
+		return retryAfter.After
+	}
 	switch n {
 	case 0:
 		return 1 * time.Second
@@ -2,27 +2,139 @@ package config
 
 import (
 	"flag"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/caarlos0/env/v10"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/hash"
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
 )
 
 type ServerConfig struct {
-	Address         string `env:"ADDRESS"`
-	StoreInterval   int    `env:"STORE_INTERVAL"`
-	FileStoragePath string `env:"FILE_STORAGE_PATH"`
-	Restore         bool   `env:"RESTORE"`
-	DatabaseDSN     string `env:"DATABASE_DSN"`
-	Key             string `env:"KEY"`
+	Address            string `env:"ADDRESS"`
+	ShutdownTimeout    int    `env:"SHUTDOWN_TIMEOUT"`
+	StoreInterval      int    `env:"STORE_INTERVAL"`
+	FileStoragePath    string `env:"FILE_STORAGE_PATH"`
+	Restore            bool   `env:"RESTORE"`
+	DatabaseDSN        string `env:"DATABASE_DSN"`
+	Key                string `env:"KEY"`
+	GaugeTTL           int    `env:"GAUGE_TTL"`
+	CounterTTL         int    `env:"COUNTER_TTL"`
+	StaleRetention     int    `env:"STALE_RETENTION"`
+	JanitorInterval    int    `env:"JANITOR_INTERVAL"`
+	RawRetention       int    `env:"RAW_RETENTION_DAYS"`
+	HourlyRetention    int    `env:"HOURLY_RETENTION_DAYS"`
+	CompactInterval    int    `env:"COMPACT_INTERVAL"`
+	PrintMigrations    bool
+	DBBatchSize        int    `env:"DB_BATCH_SIZE"`
+	Storage            string `env:"STORAGE"`
+	WALDir             string `env:"WAL_DIR"`
+	WALSync            string `env:"WAL_SYNC"`
+	WALSyncInterval    int    `env:"WAL_SYNC_INTERVAL"`
+	CheckpointInterval int    `env:"CHECKPOINT_INTERVAL"`
+	SnapshotGzip       bool   `env:"SNAPSHOT_GZIP"`
+	SnapshotKeep       int    `env:"SNAPSHOT_KEEP"`
+	MemoryShards       int    `env:"MEMORY_SHARDS"`
+	Replication        bool   `env:"REPLICATION"`
+	ReplicaOf          string `env:"REPLICA_OF"`
+	Upstream           string `env:"UPSTREAM"`
+	RelayAggregate     bool   `env:"RELAY_AGGREGATE"`
+	RelayInterval      int    `env:"RELAY_INTERVAL"`
+	RelaySpoolDir      string `env:"RELAY_SPOOL_DIR"`
+	RelayTimeout       int    `env:"RELAY_TIMEOUT"`
+	TenantsFile        string `env:"TENANTS_FILE"`
+	TokenStore         string `env:"TOKEN_STORE"`
+	TokensFile         string `env:"TOKENS_FILE"`
+	TokenCacheTTL      int    `env:"TOKEN_CACHE_TTL"`
+	ReplicaToken       string `env:"REPLICA_TOKEN"`
+	UpstreamToken      string `env:"UPSTREAM_TOKEN"`
+	IssueAdminToken    bool
+	TrustedSubnet      string `env:"TRUSTED_SUBNET"`
+	TrustedProxies     string `env:"TRUSTED_PROXIES"`
+	ReplayWindow       int    `env:"REPLAY_WINDOW"`
+	NonceCacheSize     int    `env:"NONCE_CACHE_SIZE"`
+	KeysFile           string `env:"KEYS_FILE"`
+	StrictSigning      bool   `env:"STRICT_SIGNING"`
+	IngestRate         int    `env:"INGEST_RATE"`
+	IngestBurst        int    `env:"INGEST_BURST"`
+	MaxBodyBytes       int64  `env:"MAX_BODY_BYTES"`
+	MaxBatchSize       int    `env:"MAX_BATCH_SIZE"`
+	IdempotencyStore   string `env:"IDEMPOTENCY_STORE"`
+	IdempotencyTTL     int    `env:"IDEMPOTENCY_TTL"`
+	IdempotencyCache   int    `env:"IDEMPOTENCY_CACHE_SIZE"`
+	NamePattern        string `env:"METRIC_NAME_PATTERN"`
+	MaxNameLength      int    `env:"METRIC_NAME_MAX"`
+	MetricTypes        string `env:"METRIC_TYPES"`
+	ReservedPrefixes   string `env:"RESERVED_PREFIXES"`
+	AllowNonFinite     bool   `env:"ALLOW_NON_FINITE"`
+	AllowNegativeDelta bool   `env:"ALLOW_NEGATIVE_DELTAS"`
+	MetadataFile       string `env:"METADATA_FILE"`
+	AgentTTL           int    `env:"AGENT_TTL"`
 }
 
 func NewServerConfig() (*ServerConfig, error) {
 	var c ServerConfig
 	flag.StringVar(&c.Address, "a", ":8080", "address and port to run server")
+	flag.IntVar(&c.ShutdownTimeout, "shutdown-timeout", 30, "time (sec) to finish requests in flight on shutdown")
 	flag.IntVar(&c.StoreInterval, "i", 300, "time interval (sec) to backup server data")
 	flag.StringVar(&c.FileStoragePath, "f", "/tmp/metrics-db.json", "path to the file to backup data")
 	flag.BoolVar(&c.Restore, "r", true, "flag to recover data from file")
 	flag.StringVar(&c.DatabaseDSN, "d", "", "url for database connection")
 	flag.StringVar(&c.Key, "k", "", "hashing key")
+	flag.IntVar(&c.GaugeTTL, "gauge-ttl", 0, "time (sec) without updates after which a gauge is stale, 0 disables expiry")
+	flag.IntVar(&c.CounterTTL, "counter-ttl", 0, "time (sec) without updates after which a counter is stale, 0 disables expiry")
+	flag.IntVar(&c.StaleRetention, "stale-retention", 3600, "time (sec) a stale metric is kept before it is purged")
+	flag.IntVar(&c.JanitorInterval, "janitor-interval", 60, "time interval (sec) to purge expired metrics")
+	flag.IntVar(&c.RawRetention, "raw-retention", 7, "days raw database rows are kept before rolling into hourly aggregates, 0 keeps them forever")
+	flag.IntVar(&c.HourlyRetention, "hourly-retention", 90, "days hourly aggregates are kept before rolling into daily aggregates, 0 keeps them forever")
+	flag.IntVar(&c.CompactInterval, "compact-interval", 3600, "time interval (sec) to compact database history")
+	flag.IntVar(&c.DBBatchSize, "db-batch-size", 100, "number of metrics written per database statement, 1 writes row by row")
+	flag.StringVar(&c.Storage, "storage", "memory", "storage backend when no database is configured: memory or wal")
+	flag.StringVar(&c.WALDir, "wal-dir", "/tmp/metrics-wal", "directory for the write-ahead log and its snapshots")
+	flag.StringVar(&c.WALSync, "wal-sync", "interval", "write-ahead log fsync policy: always, interval or never")
+	flag.IntVar(&c.WALSyncInterval, "wal-sync-interval", 1, "time interval (sec) to fsync the write-ahead log with the interval policy")
+	flag.IntVar(&c.CheckpointInterval, "checkpoint-interval", 300, "time interval (sec) to checkpoint the write-ahead log into a snapshot")
+	flag.BoolVar(&c.SnapshotGzip, "snapshot-gzip", false, "compress file backups with gzip")
+	flag.IntVar(&c.SnapshotKeep, "snapshot-keep", 3, "number of file backups to keep for recovery")
+	flag.IntVar(&c.MemoryShards, "memory-shards", 32, "number of independently locked shards of the in-memory storage")
+	flag.BoolVar(&c.Replication, "replication", false, "stream accepted writes to followers")
+	flag.StringVar(&c.ReplicaOf, "replica-of", "", "address of the leader to follow; the server stays read-only until promoted")
+	flag.StringVar(&c.Upstream, "upstream", "", "address of the upstream server to relay accepted metrics to")
+	flag.BoolVar(&c.RelayAggregate, "relay-aggregate", false, "pre-aggregate relayed metrics and forward them once per relay interval")
+	flag.IntVar(&c.RelayInterval, "relay-interval", 10, "time interval (sec) to forward aggregated metrics and retry spooled batches")
+	flag.StringVar(&c.RelaySpoolDir, "relay-spool", "/tmp/metrics-relay", "directory to buffer relayed batches while the upstream is unavailable")
+	flag.IntVar(&c.RelayTimeout, "relay-timeout", 10, "time (sec) to wait for the upstream server to answer a relayed batch")
+	flag.StringVar(&c.TenantsFile, "tenants", "", "path to the tenant definitions file")
+	flag.StringVar(&c.TokenStore, "token-store", "", "where API tokens are kept: file or database; empty disables token auth")
+	flag.StringVar(&c.TokensFile, "tokens", "/tmp/metrics-tokens.json", "path to the API tokens file")
+	flag.IntVar(&c.TokenCacheTTL, "token-cache-ttl", 30, "time (sec) a token found in the database is cached, 0 disables caching")
+	flag.StringVar(&c.ReplicaToken, "replica-token", "", "admin token presented to the leader")
+	flag.StringVar(&c.UpstreamToken, "upstream-token", "", "write token presented to the upstream server")
+	flag.StringVar(&c.TrustedSubnet, "t", "", "comma-separated CIDRs agents may report from, empty allows any address")
+	flag.StringVar(&c.TrustedProxies, "trusted-proxies", "", "comma-separated CIDRs of reverse proxies whose X-Real-IP header names the client")
+	flag.IntVar(&c.ReplayWindow, "replay-window", 300, "allowed clock skew (sec) of signed requests")
+	flag.IntVar(&c.NonceCacheSize, "nonce-cache", 100000, "number of request nonces remembered to refuse replays")
+	flag.StringVar(&c.KeysFile, "keys", "", "path to the signing keys file, reloaded on SIGHUP; overrides the hashing key")
+	flag.BoolVar(&c.StrictSigning, "strict-signing", false, "reject unsigned writes when a hashing key is configured")
+	flag.IntVar(&c.IngestRate, "ingest-rate", 0, "write requests per second allowed per agent, 0 disables rate limiting")
+	flag.IntVar(&c.IngestBurst, "ingest-burst", 10, "write requests an agent may make at once")
+	flag.Int64Var(&c.MaxBodyBytes, "max-body", 10<<20, "maximum request body size in bytes, also after decompression")
+	flag.IntVar(&c.MaxBatchSize, "max-batch", 10000, "maximum number of metrics in one batch")
+	flag.StringVar(&c.IdempotencyStore, "idempotency-store", "memory", "where write results are kept for retries: memory or database; empty disables idempotency keys")
+	flag.IntVar(&c.IdempotencyTTL, "idempotency-ttl", 3600, "time (sec) a write result is kept for retries with the same idempotency key")
+	flag.IntVar(&c.IdempotencyCache, "idempotency-cache", 100000, "number of write results kept by the memory idempotency store")
+	flag.StringVar(&c.NamePattern, "name-pattern", "", "regular expression metric names must match, empty refuses only control characters")
+	flag.IntVar(&c.MaxNameLength, "name-max", 255, "maximum metric name length in bytes, 0 disables the limit")
+	flag.StringVar(&c.MetricTypes, "metric-types", "gauge,counter", "comma-separated metric types accepted for ingest")
+	flag.StringVar(&c.ReservedPrefixes, "reserved-prefixes", "", "comma-separated name prefixes agents may not write")
+	flag.BoolVar(&c.AllowNonFinite, "allow-non-finite", false, "accept NaN and infinite gauge values")
+	flag.BoolVar(&c.AllowNegativeDelta, "allow-negative-deltas", false, "accept negative counter deltas")
+	flag.StringVar(&c.MetadataFile, "metadata", "", "path to the metric metadata registry file")
+	flag.IntVar(&c.AgentTTL, "agent-ttl", 86400, "time (sec) without reports after which the cumulative totals of an agent are forgotten, 0 keeps them")
+	flag.BoolVar(&c.IssueAdminToken, "issue-admin-token", false, "issue an admin API token, print it and exit")
+	flag.BoolVar(&c.PrintMigrations, "print-migrations", false, "print pending database migrations and exit")
 	flag.Parse()
 
 	err := env.Parse(&c)
@@ -31,3 +143,64 @@ func NewServerConfig() (*ServerConfig, error) {
 	}
 	return &c, nil
 }
+
+func (c *ServerConfig) TTL() map[string]time.Duration {
+	return map[string]time.Duration{
+		models.GaugeType:   time.Duration(c.GaugeTTL) * time.Second,
+		models.CounterType: time.Duration(c.CounterTTL) * time.Second,
+	}
+}
+
+// Keyring loads the signing keys from KeysFile, falling back to the single Key.
+func (c *ServerConfig) Keyring() (*hash.Keyring, error) {
+	if c.KeysFile == "" {
+		return hash.NewKeyring(c.Key), nil
+	}
+	return hash.LoadKeyring(c.KeysFile)
+}
+
+func (c *ServerConfig) TrustedNets() ([]*net.IPNet, error) {
+	return cidrs(c.TrustedSubnet)
+}
+
+// ProxyNets lists the reverse proxies trusted to name the client.
+func (c *ServerConfig) ProxyNets() ([]*net.IPNet, error) {
+	return cidrs(c.TrustedProxies)
+}
+
+func cidrs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Types lists the metric types accepted for ingest.
+func (c *ServerConfig) Types() []string {
+	return list(c.MetricTypes)
+}
+
+// Prefixes lists the metric name prefixes agents may not write.
+func (c *ServerConfig) Prefixes() []string {
+	return list(c.ReservedPrefixes)
+}
+
+func list(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
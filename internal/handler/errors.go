@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-http-utils/headers"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/auth"
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/service"
+)
+
+var (
+	ErrBadRequest     = errors.New("malformed request")
+	ErrTooLarge       = errors.New("request is too large")
+	ErrUnauthorized   = errors.New("authentication required")
+	ErrForbidden      = errors.New("token lacks the required scope")
+	ErrUntrusted      = errors.New("address is not trusted")
+	ErrUnknownKey     = errors.New("unknown signing key")
+	ErrBadSignature   = errors.New("invalid or replayed signature")
+	ErrNotSigned      = errors.New("request must be signed")
+	ErrReplayBusy     = errors.New("too many signed requests to check for replays")
+	ErrRateLimited    = errors.New("rate limit exceeded")
+	ErrReadOnly       = errors.New("server is read-only")
+	ErrTokensDisabled = errors.New("token store is not configured")
+	ErrUnknownTenant  = errors.New("unknown tenant")
+	ErrNotStreamable  = errors.New("response cannot be streamed")
+)
+
+// codes maps errors to the stable codes clients match on; the first match
+// wins.
+var codes = []struct {
+	err  error
+	code string
+}{
+	{service.ErrIDIsEmpty, "id_empty"},
+	{service.ErrUnknownMetricType, "unknown_type"},
+	{service.ErrValueUndefined, "value_undefined"},
+	{service.ErrDeltaUndefined, "delta_undefined"},
+	{service.ErrUnknownKind, "unknown_kind"},
+	{service.ErrNegativeTotal, "negative_total"},
+	{service.ErrNameTooLong, "name_too_long"},
+	{service.ErrNameInvalid, "name_invalid"},
+	{service.ErrNameReserved, "name_reserved"},
+	{service.ErrTypeNotAllowed, "type_not_allowed"},
+	{service.ErrNonFinite, "non_finite"},
+	{service.ErrNegativeDelta, "negative_delta"},
+	{service.ErrTypeConflict, "type_conflict"},
+	{service.ErrNotFound, "not_found"},
+	{service.ErrNoHistory, "no_history"},
+	{service.ErrReplicationDisabled, "replication_disabled"},
+	{service.ErrNotFollower, "not_follower"},
+	{auth.ErrNotFound, "token_not_found"},
+	{ErrBadRequest, "bad_request"},
+	{ErrTooLarge, "too_large"},
+	{ErrUnauthorized, "unauthorized"},
+	{ErrForbidden, "forbidden"},
+	{ErrUntrusted, "untrusted"},
+	{ErrUnknownKey, "unknown_key"},
+	{ErrBadSignature, "bad_signature"},
+	{ErrNotSigned, "not_signed"},
+	{ErrReplayBusy, "replay_busy"},
+	{ErrRateLimited, "rate_limited"},
+	{ErrReadOnly, "read_only"},
+	{ErrTokensDisabled, "tokens_disabled"},
+	{ErrUnknownTenant, "unknown_tenant"},
+	{ErrNotStreamable, "not_streamable"},
+}
+
+// plainRoutes answer errors in plain text unless the client asks for JSON.
+var plainRoutes = map[string]bool{
+	"/update/{metricType}/{metricName}/{metricValue}": true,
+	"/value/{metricType}/{metricName}":                true,
+}
+
+// writeError sends err in the error envelope. Errors without a code are
+// logged and their details kept from the client.
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	e := models.Error{Code: "internal", Message: http.StatusText(status)}
+	for _, c := range codes {
+		if errors.Is(err, c.err) {
+			e.Code, e.Message = c.code, err.Error()
+			break
+		}
+	}
+	if e.Code == "internal" {
+		logger.Error(err.Error())
+	}
+	var fe *service.FieldError
+	if errors.As(err, &fe) {
+		e.Field = fe.Field
+	}
+
+	if !wantsJSON(r) {
+		w.Header().Set(headers.ContentType, "text/plain")
+		w.WriteHeader(status)
+		_, err = fmt.Fprintln(w, e.Message)
+		logger.LogErrorIfNotNil(err)
+		return
+	}
+	w.Header().Set(headers.ContentType, "application/json")
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(e)
+	logger.LogErrorIfNotNil(err)
+}
+
+// bodyError reports a failure to read or decode the request body.
+func bodyError(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, ErrTooLarge)
+		return
+	}
+	writeError(w, r, http.StatusBadRequest, fmt.Errorf("%w: %s", ErrBadRequest, err.Error()))
+}
+
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get(headers.Accept)
+	if strings.Contains(accept, "application/json") {
+		return true
+	}
+	if strings.Contains(accept, "text/plain") {
+		return false
+	}
+	rctx := chi.RouteContext(r.Context())
+	return rctx == nil || !plainRoutes[rctx.RoutePattern()]
+}
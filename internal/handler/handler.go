@@ -1,26 +1,46 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"html/template"
 	"io"
+	"net"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-http-utils/headers"
 
+	"github.com/dkrasnykh/metrics-alerter/internal/auth"
+	"github.com/dkrasnykh/metrics-alerter/internal/hash"
+	"github.com/dkrasnykh/metrics-alerter/internal/idempotency"
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+	"github.com/dkrasnykh/metrics-alerter/internal/metadata"
 	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/ratelimit"
+	"github.com/dkrasnykh/metrics-alerter/internal/replication"
 	"github.com/dkrasnykh/metrics-alerter/internal/service"
+	"github.com/dkrasnykh/metrics-alerter/internal/tenant"
 )
 
 const (
+	DefaultReplayWindow = 5 * time.Minute
+	DefaultNonceCache   = 100000
+	DefaultMaxBody      = 10 << 20
+	DefaultMaxBatch     = 10000
+
+	// historyWindow is how far back history goes without a from parameter.
+	historyWindow = 24 * time.Hour
+
 	Tpl = `
 	<!DOCTYPE html>
 	<html>
 		<body>
-			{{range .Metrics}}<div>{{ .MType }} {{ .ID }} {{ .Delta }} {{ .Value }}</div>{{end}}
+			{{range .Metrics}}<div>{{ .MType }} {{ .ID }} {{ .Delta }} {{ .Value }}{{ if .Unit }} {{ .Unit }}{{ end }}{{ if .Stale }} (stale){{ end }}{{ if .Description }} <i>{{ .Description }}</i>{{ end }}</div>{{end}}
 		</body>
 	</html>`
 )
@@ -29,31 +49,135 @@ var T *template.Template
 
 type Handler struct {
 	service *service.Service
-	key     string
+	keys    *hash.Keyring
+	tenants *tenant.Registry
+	tokens  auth.Store
+	trusted []*net.IPNet
+	proxies []*net.IPNet
+
+	replayWindow time.Duration
+	nonces       *hash.NonceCache
+	strict       bool
+
+	limiter  *ratelimit.Limiter
+	maxBody  int64
+	maxBatch int
+
+	idempotency idempotency.Store
+	locks       idempotency.Locks
 }
 
 func New(s *service.Service, key string) *Handler {
 	return &Handler{
-		service: s,
-		key:     key,
+		service:      s,
+		keys:         hash.NewKeyring(key),
+		replayWindow: DefaultReplayWindow,
+		nonces:       hash.NewNonceCache(DefaultReplayWindow, DefaultNonceCache),
+		maxBody:      DefaultMaxBody,
+		maxBatch:     DefaultMaxBatch,
 	}
 }
 
+// SetLimits must be called before InitRoutes. maxBody caps request bodies in
+// bytes both as sent and decompressed, maxBatch the metrics in one batch, and
+// a non-nil limiter throttles writes per agent.
+func (h *Handler) SetLimits(maxBody int64, maxBatch int, limiter *ratelimit.Limiter) {
+	h.maxBody = maxBody
+	h.maxBatch = maxBatch
+	h.limiter = limiter
+}
+
+// SetIdempotency must be called before InitRoutes; without a store
+// idempotency keys are ignored.
+func (h *Handler) SetIdempotency(s idempotency.Store) {
+	h.idempotency = s
+}
+
+// SetReplayWindow must be called before InitRoutes. Signed requests are
+// accepted only within window of their timestamp, and size nonces are
+// remembered to refuse repeats.
+func (h *Handler) SetReplayWindow(window time.Duration, size int) {
+	h.replayWindow = window
+	h.nonces = hash.NewNonceCache(window, size)
+}
+
+// SetKeyring must be called before InitRoutes; it replaces the single key
+// given to New.
+func (h *Handler) SetKeyring(k *hash.Keyring) {
+	h.keys = k
+}
+
+// SetStrictSigning must be called before InitRoutes; when on, writes must be
+// signed whenever a key is configured.
+func (h *Handler) SetStrictSigning(strict bool) {
+	h.strict = strict
+}
+
+// SetTenants must be called before InitRoutes; without a registry every
+// request works in the default namespace.
+func (h *Handler) SetTenants(r *tenant.Registry) {
+	h.tenants = r
+}
+
+// SetTokens must be called before InitRoutes; without a store no route
+// requires a token.
+func (h *Handler) SetTokens(s auth.Store) {
+	h.tokens = s
+}
+
+// SetTrustedSubnets must be called before InitRoutes; without subnets
+// ingest is accepted from any address.
+func (h *Handler) SetTrustedSubnets(nets []*net.IPNet) {
+	h.trusted = nets
+}
+
+// SetTrustedProxies must be called before InitRoutes; only requests from
+// these proxies may name the client in X-Real-IP.
+func (h *Handler) SetTrustedProxies(nets []*net.IPNet) {
+	h.proxies = nets
+}
+
 func (h *Handler) InitRoutes() *chi.Mux {
 	r := chi.NewRouter()
 
-	r.Use(h.Hash)
-	r.Use(h.GzipRequest)
-	r.Use(h.GzipResponse)
-	r.Use(h.Logging)
+	r.Group(func(r chi.Router) {
+		r.Use(h.LimitBody)
+		r.Use(h.Authenticate)
+		r.Use(h.Tenant)
+		r.Use(h.GzipResponse)
+		r.Use(h.Hash)
+		r.Use(h.GzipRequest)
+		r.Use(h.Logging)
+
+		r.With(h.Require(auth.ScopeWrite), h.RateLimit, h.Signed, h.Trusted, h.Writable, h.Idempotent).
+			Post("/update/{metricType}/{metricName}/{metricValue}", h.HandleUpdateByParam)
+		r.With(h.Require(auth.ScopeRead)).Get("/value/{metricType}/{metricName}", h.HandleGetByParam)
+		r.With(h.Require(auth.ScopeRead)).Get("/", h.HandleGetAll)
+		r.With(h.Require(auth.ScopeWrite), h.RateLimit, h.Signed, h.Trusted, h.Writable, h.Idempotent).
+			Post("/update/", h.HandleUpdate)
+		r.With(h.Require(auth.ScopeRead)).Post("/value/", h.HandleGet)
+		r.With(h.Require(auth.ScopeWrite), h.RateLimit, h.Signed, h.Trusted, h.Writable, h.Idempotent).
+			Post("/updates/", h.HandleUpdates)
+		r.With(h.Require(auth.ScopeRead)).Get("/history/{metricType}/{metricName}", h.HandleHistory)
+		r.With(h.Require(auth.ScopeRead)).Get("/metadata/", h.HandleGetMetadata)
+		r.With(h.Require(auth.ScopeWrite), h.RateLimit, h.Signed, h.Trusted, h.Writable).
+			Post("/metadata/", h.HandleDescribe)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(h.LimitBody)
+		r.Use(h.Authenticate)
+		r.Use(h.GzipResponse)
+		r.Use(h.Hash)
+		r.Use(h.GzipRequest)
+		r.Use(h.Logging)
 
-	r.Post("/update/{metricType}/{metricName}/{metricValue}", h.HandleUpdateByParam)
-	r.Get("/value/{metricType}/{metricName}", h.HandleGetByParam)
-	r.Get("/", h.HandleGetAll)
-	r.Post("/update/", h.HandleUpdate)
-	r.Post("/value/", h.HandleGet)
-	r.Get("/ping", h.HandleGetPing)
-	r.Post("/updates/", h.HandleUpdates)
+		r.Get("/ping", h.HandleGetPing)
+		r.With(h.Admin).Get(replication.StreamPath, h.HandleReplicationStream)
+		r.With(h.Admin).Post("/replication/promote", h.HandlePromote)
+		r.With(h.Require(auth.ScopeAdmin)).Get("/admin/tokens", h.HandleListTokens)
+		r.With(h.Require(auth.ScopeAdmin)).Post("/admin/tokens", h.HandleIssueToken)
+		r.With(h.Require(auth.ScopeAdmin)).Delete("/admin/tokens/{id}", h.HandleRevokeToken)
+	})
 
 	return r
 }
@@ -65,19 +189,20 @@ func (h *Handler) HandleUpdateByParam(res http.ResponseWriter, req *http.Request
 	res.Header().Set(headers.ContentType, "text/plain")
 
 	m := convert(metricType, metricName, metricValue)
-	err := h.service.Validate(m)
+	err := h.service.Validate(req.Context(), m)
 	if err != nil {
 		if errors.Is(err, service.ErrIDIsEmpty) {
-			res.WriteHeader(http.StatusNotFound)
+			writeError(res, req, http.StatusNotFound, err)
 			return
 		}
-		res.WriteHeader(http.StatusBadRequest)
+		writeError(res, req, http.StatusBadRequest, err)
 		return
 	}
 
 	_, err = h.service.Save(req.Context(), m)
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
+		writeError(res, req, http.StatusInternalServerError, err)
+		return
 	}
 	res.WriteHeader(http.StatusOK)
 }
@@ -87,126 +212,375 @@ func (h *Handler) HandleGetByParam(res http.ResponseWriter, req *http.Request) {
 	res.Header().Set(headers.ContentType, "text/plain")
 
 	value, err := h.service.GetMetricValue(req.Context(), metricType, metricName)
-
 	if err != nil {
-		res.WriteHeader(http.StatusNotFound)
+		writeError(res, req, getStatus(err), err)
 		return
 	}
 	_, err = res.Write([]byte(value))
-	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	res.WriteHeader(http.StatusOK)
+	logger.LogErrorIfNotNil(err)
 }
 
 func (h *Handler) HandleGetAll(res http.ResponseWriter, req *http.Request) {
 	res.Header().Set(headers.ContentType, `text/html`)
+	type Row struct {
+		models.Metrics
+		Unit        string
+		Description string
+	}
 	type Item struct {
-		Metrics []models.Metrics
+		Metrics []Row
 	}
 	metrics, err := h.service.GetAll(req.Context())
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
+		writeError(res, req, http.StatusInternalServerError, err)
 		return
 	}
-	err = T.Execute(res, Item{Metrics: metrics})
+	rows := make([]Row, 0, len(metrics))
+	for _, m := range metrics {
+		meta, _ := h.service.Meta(req.Context(), m.ID)
+		rows = append(rows, Row{Metrics: m, Unit: meta.Unit, Description: meta.Description})
+	}
+	err = T.Execute(res, Item{Metrics: rows})
+	logger.LogErrorIfNotNil(err)
+}
+
+func (h *Handler) HandleUpdate(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set(headers.ContentType, "application/json")
+	m, err := extractBody(req)
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
+		bodyError(res, req, err)
 		return
 	}
-	res.WriteHeader(http.StatusOK)
+	err = h.service.Validate(req.Context(), *m)
+	if err != nil {
+		writeError(res, req, http.StatusBadRequest, err)
+		return
+	}
+	*m, err = h.service.Save(h.agentContext(req), *m)
+	if err != nil {
+		writeError(res, req, http.StatusInternalServerError, err)
+		return
+	}
+	err = json.NewEncoder(res).Encode(*m)
+	logger.LogErrorIfNotNil(err)
 }
 
-func (h *Handler) HandleUpdate(res http.ResponseWriter, req *http.Request) {
+func (h *Handler) HandleGet(res http.ResponseWriter, req *http.Request) {
 	res.Header().Set(headers.ContentType, "application/json")
 	m, err := extractBody(req)
 	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
+		bodyError(res, req, err)
 		return
 	}
-	err = h.service.Validate(*m)
+	if m.MType != models.CounterType && m.MType != models.GaugeType {
+		writeError(res, req, http.StatusBadRequest, &service.FieldError{Field: "type", Err: service.ErrUnknownMetricType})
+		return
+	}
+	*m, err = h.service.Get(req.Context(), (*m).MType, (*m).ID)
 	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
+		writeError(res, req, getStatus(err), err)
 		return
 	}
-	*m, err = h.service.Save(req.Context(), *m)
+	err = json.NewEncoder(res).Encode(*m)
+	logger.LogErrorIfNotNil(err)
+}
+
+func (h *Handler) HandleGetPing(res http.ResponseWriter, req *http.Request) {
+	err := h.service.Ping(req.Context())
+	if err != nil {
+		writeError(res, req, http.StatusInternalServerError, err)
+	}
+}
+
+func (h *Handler) HandleUpdates(res http.ResponseWriter, req *http.Request) {
+	bytes, err := io.ReadAll(req.Body)
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
+		bodyError(res, req, err)
 		return
 	}
-	buf, err := json.Marshal(*m)
+	metrics := []models.Metrics{}
+	err = json.Unmarshal(bytes, &metrics)
 	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
+		bodyError(res, req, err)
+		return
+	}
+	if len(metrics) > h.maxBatch {
+		writeError(res, req, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("%w: batch exceeds %d metrics", ErrTooLarge, h.maxBatch))
 		return
 	}
-	_, err = res.Write(buf)
+	if req.Header.Get(models.PartialHeader) == "true" {
+		h.loadPartial(res, req, metrics)
+		return
+	}
+	for i, m := range metrics {
+		err = h.service.Validate(req.Context(), m)
+		if err != nil {
+			writeError(res, req, http.StatusBadRequest, fmt.Errorf("metric %d: %w", i, err))
+			return
+		}
+	}
+	err = h.service.Load(h.agentContext(req), metrics)
 	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
+		writeError(res, req, http.StatusInternalServerError, err)
+	}
+}
+
+func (h *Handler) loadPartial(res http.ResponseWriter, req *http.Request, metrics []models.Metrics) {
+	report := models.BatchReport{Rejected: []models.Rejected{}}
+	valid := make([]models.Metrics, 0, len(metrics))
+	for i, m := range metrics {
+		err := h.service.Validate(req.Context(), m)
+		if err != nil {
+			report.Rejected = append(report.Rejected, models.Rejected{Index: i, ID: m.ID, Reason: err.Error()})
+			continue
+		}
+		valid = append(valid, m)
+	}
+	if len(valid) > 0 {
+		err := h.service.Load(h.agentContext(req), valid)
+		if err != nil {
+			writeError(res, req, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	report.Accepted = len(valid)
+	res.Header().Set(headers.ContentType, "application/json")
+	err := json.NewEncoder(res).Encode(report)
+	logger.LogErrorIfNotNil(err)
+}
+
+// HandleHistory returns the points of a metric between the from and to
+// query parameters, RFC 3339 times defaulting to the last day.
+func (h *Handler) HandleHistory(res http.ResponseWriter, req *http.Request) {
+	to := time.Now()
+	var err error
+	if v := req.URL.Query().Get("to"); v != "" {
+		to, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(res, req, http.StatusBadRequest, fmt.Errorf("%w: to: %s", ErrBadRequest, err.Error()))
+			return
+		}
+	}
+	from := to.Add(-historyWindow)
+	if v := req.URL.Query().Get("from"); v != "" {
+		from, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(res, req, http.StatusBadRequest, fmt.Errorf("%w: from: %s", ErrBadRequest, err.Error()))
+			return
+		}
+	}
+	points, err := h.service.History(req.Context(), chi.URLParam(req, "metricType"), chi.URLParam(req, "metricName"), from, to)
+	switch {
+	case errors.Is(err, service.ErrUnknownMetricType):
+		writeError(res, req, http.StatusBadRequest, err)
+		return
+	case errors.Is(err, service.ErrNoHistory):
+		writeError(res, req, http.StatusNotImplemented, err)
+		return
+	case err != nil:
+		writeError(res, req, http.StatusInternalServerError, err)
 		return
 	}
-	res.WriteHeader(http.StatusOK)
+	res.Header().Set(headers.ContentType, "application/json")
+	err = json.NewEncoder(res).Encode(points)
+	logger.LogErrorIfNotNil(err)
 }
 
-func (h *Handler) HandleGet(res http.ResponseWriter, req *http.Request) {
+func (h *Handler) HandleGetMetadata(res http.ResponseWriter, req *http.Request) {
 	res.Header().Set(headers.ContentType, "application/json")
-	m, err := extractBody(req)
+	err := json.NewEncoder(res).Encode(h.service.Metadata(req.Context()))
+	logger.LogErrorIfNotNil(err)
+}
+
+// HandleDescribe takes metadata about metric names from agents; a type other
+// than the registered one is refused.
+func (h *Handler) HandleDescribe(res http.ResponseWriter, req *http.Request) {
+	metas := []metadata.Meta{}
+	err := json.NewDecoder(req.Body).Decode(&metas)
 	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
+		bodyError(res, req, err)
 		return
 	}
-	if m.MType != models.CounterType && m.MType != models.GaugeType {
-		res.WriteHeader(http.StatusBadRequest)
+	err = h.service.Describe(req.Context(), metas)
+	if errors.Is(err, service.ErrTypeConflict) {
+		writeError(res, req, http.StatusConflict, err)
 		return
 	}
-	*m, err = h.service.Get(req.Context(), (*m).MType, (*m).ID)
 	if err != nil {
-		res.WriteHeader(http.StatusNotFound)
+		writeError(res, req, http.StatusBadRequest, fmt.Errorf("%w: %s", ErrBadRequest, err.Error()))
 		return
 	}
-	buf, err := json.Marshal(*m)
+	res.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) HandleReplicationStream(res http.ResponseWriter, req *http.Request) {
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		writeError(res, req, http.StatusNotAcceptable, ErrNotStreamable)
+		return
+	}
+	snapshot, events, err := h.service.Subscribe(req.Context())
 	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
+		if errors.Is(err, service.ErrReplicationDisabled) {
+			writeError(res, req, http.StatusNotFound, err)
+			return
+		}
+		writeError(res, req, http.StatusInternalServerError, err)
 		return
 	}
-	_, err = res.Write(buf)
+	defer h.service.Unsubscribe(events)
+
+	res.Header().Set(headers.ContentType, "application/x-ndjson")
+	enc := json.NewEncoder(res)
+	for _, e := range snapshot {
+		err = enc.Encode(e)
+		if err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			err = enc.Encode(e)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (h *Handler) HandlePromote(res http.ResponseWriter, req *http.Request) {
+	err := h.service.Promote()
 	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
+		writeError(res, req, http.StatusConflict, err)
 		return
 	}
 	res.WriteHeader(http.StatusOK)
 }
 
-func (h *Handler) HandleGetPing(res http.ResponseWriter, req *http.Request) {
-	err := h.service.Ping(req.Context())
+func (h *Handler) HandleListTokens(res http.ResponseWriter, req *http.Request) {
+	if h.tokens == nil {
+		writeError(res, req, http.StatusNotFound, ErrTokensDisabled)
+		return
+	}
+	tokens, err := h.visibleTokens(req.Context())
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
+		writeError(res, req, http.StatusInternalServerError, err)
+		return
 	}
+	for i := range tokens {
+		tokens[i].Hash = ""
+	}
+	res.Header().Set(headers.ContentType, "application/json")
+	err = json.NewEncoder(res).Encode(tokens)
+	logger.LogErrorIfNotNil(err)
 }
 
-func (h *Handler) HandleUpdates(res http.ResponseWriter, req *http.Request) {
-	bytes, err := io.ReadAll(req.Body)
-	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
+// HandleIssueToken returns the token secret exactly once; only its hash is
+// kept. A tenant-bound caller may only issue tokens for its own tenant.
+func (h *Handler) HandleIssueToken(res http.ResponseWriter, req *http.Request) {
+	if h.tokens == nil {
+		writeError(res, req, http.StatusNotFound, ErrTokensDisabled)
 		return
 	}
-	metrics := []models.Metrics{}
-	err = json.Unmarshal(bytes, &metrics)
+	var r struct {
+		Scopes []string `json:"scopes"`
+		Tenant string   `json:"tenant"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&r)
 	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
+		bodyError(res, req, err)
 		return
 	}
-	for _, m := range metrics {
-		err = h.service.Validate(m)
-		if err != nil {
-			res.WriteHeader(http.StatusBadRequest)
+	if caller, _ := auth.FromContext(req.Context()); caller.Tenant != "" && r.Tenant != caller.Tenant {
+		writeError(res, req, http.StatusForbidden, fmt.Errorf("%w: tokens can only be issued for tenant %s", ErrForbidden, caller.Tenant))
+		return
+	}
+	if r.Tenant != "" && h.tenants != nil {
+		if _, ok := h.tenants.ByID(r.Tenant); !ok {
+			writeError(res, req, http.StatusBadRequest, fmt.Errorf("%w %s", ErrUnknownTenant, r.Tenant))
 			return
 		}
 	}
-	err = h.service.Load(req.Context(), metrics)
+	secret, t, err := auth.Issue(req.Context(), h.tokens, r.Scopes, r.Tenant)
+	if err != nil {
+		writeError(res, req, http.StatusBadRequest, fmt.Errorf("%w: %s", ErrBadRequest, err.Error()))
+		return
+	}
+	t.Hash = ""
+	res.Header().Set(headers.ContentType, "application/json")
+	res.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(res).Encode(struct {
+		auth.Token
+		Secret string `json:"token"`
+	}{t, secret})
+	logger.LogErrorIfNotNil(err)
+}
+
+func (h *Handler) HandleRevokeToken(res http.ResponseWriter, req *http.Request) {
+	if h.tokens == nil {
+		writeError(res, req, http.StatusNotFound, ErrTokensDisabled)
+		return
+	}
+	id := chi.URLParam(req, "id")
+	err := h.visibleToken(req.Context(), id)
+	if err == nil {
+		err = h.tokens.Revoke(req.Context(), id)
+	}
+	if errors.Is(err, auth.ErrNotFound) {
+		writeError(res, req, http.StatusNotFound, err)
+		return
+	}
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
+		writeError(res, req, http.StatusInternalServerError, err)
+		return
 	}
+	res.WriteHeader(http.StatusOK)
+}
+
+// visibleTokens lists every token to a global caller and only the tokens of
+// its tenant to a tenant-bound one.
+func (h *Handler) visibleTokens(ctx context.Context) ([]auth.Token, error) {
+	tokens, err := h.tokens.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	caller, _ := auth.FromContext(ctx)
+	if caller.Tenant == "" {
+		return tokens, nil
+	}
+	visible := tokens[:0]
+	for _, t := range tokens {
+		if t.Tenant == caller.Tenant {
+			visible = append(visible, t)
+		}
+	}
+	return visible, nil
+}
+
+// visibleToken reports auth.ErrNotFound for a token the caller cannot see.
+func (h *Handler) visibleToken(ctx context.Context, id string) error {
+	if caller, _ := auth.FromContext(ctx); caller.Tenant == "" {
+		return nil
+	}
+	tokens, err := h.visibleTokens(ctx)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if t.ID == id {
+			return nil
+		}
+	}
+	return auth.ErrNotFound
 }
 
 func extractBody(req *http.Request) (*models.Metrics, error) {
@@ -225,6 +599,30 @@ func extractBody(req *http.Request) (*models.Metrics, error) {
 	return &m, nil
 }
 
+// agentContext names the agent as agentID does. A missing or malformed epoch
+// is 0, which the service takes as an agent started before it.
+func (h *Handler) agentContext(r *http.Request) context.Context {
+	epoch, _ := strconv.ParseInt(r.Header.Get(models.EpochHeader), 10, 64)
+	return service.WithAgent(r.Context(), h.agentID(r), epoch)
+}
+
+// agentID is the ID the agent reports about itself, falling back to its
+// address.
+func (h *Handler) agentID(r *http.Request) string {
+	if id := r.Header.Get(models.AgentHeader); id != "" {
+		return id
+	}
+	return h.clientIP(r)
+}
+
+// getStatus tells a missing metric from a storage failure.
+func getStatus(err error) int {
+	if errors.Is(err, service.ErrNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
 func convert(mtype, mname, value string) models.Metrics {
 	m := models.Metrics{MType: mtype, ID: mname}
 	switch mtype {
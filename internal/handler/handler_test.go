@@ -1,21 +1,37 @@
 package handler
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
+	"html/template"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-http-utils/headers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/dkrasnykh/metrics-alerter/internal/auth"
+	"github.com/dkrasnykh/metrics-alerter/internal/hash"
+	"github.com/dkrasnykh/metrics-alerter/internal/idempotency"
 	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+	"github.com/dkrasnykh/metrics-alerter/internal/metadata"
 	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/ratelimit"
 	"github.com/dkrasnykh/metrics-alerter/internal/service"
 	"github.com/dkrasnykh/metrics-alerter/internal/storage/memory"
+	"github.com/dkrasnykh/metrics-alerter/internal/tenant"
 )
 
 func TestHandleUpdateByParam(t *testing.T) {
@@ -31,6 +47,7 @@ func TestHandleUpdateByParam(t *testing.T) {
 		request     string
 		code        int
 		contentType string
+		response    string
 	}{
 		{
 			name:        "success update counter",
@@ -49,18 +66,21 @@ func TestHandleUpdateByParam(t *testing.T) {
 			request:     "/update/test/test/100",
 			code:        http.StatusBadRequest,
 			contentType: "text/plain",
+			response:    "unknown metric type\n",
 		},
 		{
 			name:        "invalid url - bad value",
 			request:     "/update/test/test/test",
 			code:        http.StatusBadRequest,
 			contentType: "text/plain",
+			response:    "unknown metric type\n",
 		},
 		{
 			name:        "invalid url - metric name is empty",
 			request:     "/update/gauge//100",
 			code:        http.StatusNotFound,
 			contentType: "text/plain",
+			response:    "metric ID is empty\n",
 		},
 	}
 
@@ -84,7 +104,7 @@ func TestHandleUpdateByParam(t *testing.T) {
 
 			assert.Equal(t, test.code, resp.StatusCode)
 			assert.Equal(t, test.contentType, contentType)
-			assert.Empty(t, string(respBody))
+			assert.Equal(t, test.response, string(respBody))
 		})
 	}
 }
@@ -127,7 +147,7 @@ func TestHandleGetByParam(t *testing.T) {
 			name:     "unknown metric name",
 			request:  "/value/gauge/unknown",
 			code:     http.StatusNotFound,
-			response: "",
+			response: "value by gauge type and unknown name: metric not found\n",
 		},
 	}
 	for _, test := range tests {
@@ -150,3 +170,762 @@ func TestHandleGetByParam(t *testing.T) {
 		})
 	}
 }
+
+func TestTenants(t *testing.T) {
+	_ = logger.InitLogger()
+	tenants, err := tenant.NewRegistry([]tenant.Tenant{{ID: "a", Key: "ka"}, {ID: "b", Token: "tb"}})
+	require.NoError(t, err)
+	h := New(service.New(memory.New("", 0)), ``)
+	h.SetTenants(tenants)
+	testServ := httptest.NewServer(h.InitRoutes())
+	defer testServ.Close()
+
+	do := func(method, path string, set func(req *http.Request)) int {
+		req, err := http.NewRequest(method, testServ.URL+path, nil)
+		require.NoError(t, err)
+		set(req)
+		resp, err := testServ.Client().Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+	signed := func(id, key string) func(req *http.Request) {
+		return func(req *http.Request) {
+			req.Header.Set(tenant.Header, id)
+			for k, v := range hash.Headers(nil, []byte(key)) {
+				req.Header.Set(k, v)
+			}
+		}
+	}
+	bearer := func(token string) func(req *http.Request) {
+		return func(req *http.Request) {
+			req.Header.Set(headers.Authorization, "Bearer "+token)
+		}
+	}
+
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/update/counter/c/5", signed("a", "ka")))
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/update/counter/c/7", bearer("tb")))
+
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "/update/counter/c/1", func(*http.Request) {}))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/value/counter/c", bearer("unknown")))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/value/counter/c", func(req *http.Request) {
+		req.Header.Set(tenant.Header, "a")
+	}))
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/value/counter/c", signed("a", "kb")))
+	assert.NotEqual(t, http.StatusUnauthorized, do(http.MethodGet, "/ping", func(*http.Request) {}))
+
+	ctx := context.Background()
+	value, err := h.service.GetMetricValue(tenant.WithID(ctx, "a"), models.CounterType, "c")
+	require.NoError(t, err)
+	assert.Equal(t, "5", value)
+	value, err = h.service.GetMetricValue(tenant.WithID(ctx, "b"), models.CounterType, "c")
+	require.NoError(t, err)
+	assert.Equal(t, "7", value)
+	_, err = h.service.GetMetricValue(ctx, models.CounterType, "c")
+	assert.Error(t, err)
+}
+
+func TestTenantToken(t *testing.T) {
+	_ = logger.InitLogger()
+	tenants, err := tenant.NewRegistry([]tenant.Tenant{{ID: "a", Key: "ka"}})
+	require.NoError(t, err)
+	tokens, err := auth.NewFileStore(filepath.Join(t.TempDir(), "tokens.json"))
+	require.NoError(t, err)
+	writer, _, err := auth.Issue(context.Background(), tokens, []string{auth.ScopeWrite}, "a")
+	require.NoError(t, err)
+	orphan, _, err := auth.Issue(context.Background(), tokens, []string{auth.ScopeWrite}, "gone")
+	require.NoError(t, err)
+	h := New(service.New(memory.New("", 0)), `global`)
+	h.SetTenants(tenants)
+	h.SetTokens(tokens)
+	h.SetStrictSigning(true)
+	testServ := httptest.NewServer(h.InitRoutes())
+	defer testServ.Close()
+
+	do := func(token, key string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, testServ.URL+"/update/counter/c/5", nil)
+		require.NoError(t, err)
+		req.Header.Set(headers.Authorization, "Bearer "+token)
+		if key != "" {
+			for k, v := range hash.Headers(nil, []byte(key)) {
+				req.Header.Set(k, v)
+			}
+		}
+		resp, err := testServ.Client().Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := do(writer, "")
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "the tenant's key must sign its writes")
+
+	resp = do(writer, "ka")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, hash.Encode(body, []byte("ka")), resp.Header.Get(hash.Header), "responses are signed with the tenant's key")
+
+	resp = do(writer, "global")
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = do(orphan, "ka")
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "a token of an unknown tenant")
+}
+
+func TestTokens(t *testing.T) {
+	_ = logger.InitLogger()
+	tokens, err := auth.NewFileStore(filepath.Join(t.TempDir(), "tokens.json"))
+	require.NoError(t, err)
+	admin, _, err := auth.Issue(context.Background(), tokens, []string{auth.ScopeAdmin}, "")
+	require.NoError(t, err)
+	h := New(service.New(memory.New("", 0)), ``)
+	h.SetTokens(tokens)
+	testServ := httptest.NewServer(h.InitRoutes())
+	defer testServ.Close()
+
+	do := func(method, path, token, body string) *http.Response {
+		req, err := http.NewRequest(method, testServ.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set(headers.Authorization, "Bearer "+token)
+		}
+		resp, err := testServ.Client().Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+	status := func(method, path, token string) int {
+		resp := do(method, path, token, "")
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+	issue := func(scopes string) (string, string) {
+		resp := do(http.MethodPost, "/admin/tokens", admin, `{"scopes":[`+scopes+`]}`)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var v struct {
+			ID    string `json:"id"`
+			Hash  string `json:"hash"`
+			Token string `json:"token"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&v))
+		assert.Empty(t, v.Hash)
+		return v.ID, v.Token
+	}
+
+	_, reader := issue(`"read"`)
+	writerID, writer := issue(`"write"`)
+
+	assert.Equal(t, http.StatusUnauthorized, status(http.MethodPost, "/update/counter/c/5", ""))
+	assert.Equal(t, http.StatusUnauthorized, status(http.MethodGet, "/value/counter/c", "unknown"))
+	assert.Equal(t, http.StatusForbidden, status(http.MethodPost, "/update/counter/c/5", reader))
+	assert.Equal(t, http.StatusOK, status(http.MethodPost, "/update/counter/c/5", writer))
+	assert.Equal(t, http.StatusForbidden, status(http.MethodGet, "/value/counter/c", writer))
+	assert.Equal(t, http.StatusOK, status(http.MethodGet, "/value/counter/c", reader))
+	assert.Equal(t, http.StatusForbidden, status(http.MethodPost, "/replication/promote", writer))
+	assert.Equal(t, http.StatusForbidden, status(http.MethodGet, "/admin/tokens", reader))
+	assert.Equal(t, http.StatusOK, status(http.MethodGet, "/admin/tokens", admin))
+
+	assert.Equal(t, http.StatusOK, status(http.MethodDelete, "/admin/tokens/"+writerID, admin))
+	assert.Equal(t, http.StatusNotFound, status(http.MethodDelete, "/admin/tokens/"+writerID, admin))
+	assert.Equal(t, http.StatusUnauthorized, status(http.MethodPost, "/update/counter/c/5", writer))
+
+	resp := do(http.MethodPost, "/admin/tokens", admin, `{"scopes":["root"]}`)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	tenantAdmin, _, err := auth.Issue(context.Background(), tokens, []string{auth.ScopeAdmin}, "a")
+	require.NoError(t, err)
+	for _, body := range []string{`{"scopes":["admin"]}`, `{"scopes":["admin"],"tenant":"b"}`} {
+		resp = do(http.MethodPost, "/admin/tokens", tenantAdmin, body)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, "a tenant admin issues tokens for its own tenant only")
+	}
+	resp = do(http.MethodPost, "/admin/tokens", tenantAdmin, `{"scopes":["read"],"tenant":"a"}`)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	readerID, _ := issue(`"read"`)
+	assert.Equal(t, http.StatusNotFound, status(http.MethodDelete, "/admin/tokens/"+readerID, tenantAdmin))
+	resp = do(http.MethodGet, "/admin/tokens", tenantAdmin, "")
+	defer resp.Body.Close()
+	var listed []auth.Token
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+	for _, l := range listed {
+		assert.Equal(t, "a", l.Tenant)
+	}
+}
+
+func TestTrusted(t *testing.T) {
+	_ = logger.InitLogger()
+	_, trusted, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	h := New(service.New(memory.New("", 0)), ``)
+	h.SetTrustedSubnets([]*net.IPNet{trusted})
+	h.SetTrustedProxies([]*net.IPNet{loopback})
+	testServ := httptest.NewServer(h.InitRoutes())
+	defer testServ.Close()
+	direct := New(service.New(memory.New("", 0)), ``)
+	direct.SetTrustedSubnets([]*net.IPNet{trusted})
+	directServ := httptest.NewServer(direct.InitRoutes())
+	defer directServ.Close()
+
+	statusOf := func(ts *httptest.Server, method, path, realIP string) int {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(`[]`))
+		require.NoError(t, err)
+		if realIP != "" {
+			req.Header.Set(headers.XRealIP, realIP)
+		}
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+	status := func(method, path, realIP string) int {
+		return statusOf(testServ, method, path, realIP)
+	}
+
+	assert.Equal(t, http.StatusOK, status(http.MethodPost, "/updates/", "192.168.1.10"))
+	assert.Equal(t, http.StatusOK, status(http.MethodPost, "/update/counter/c/1", "192.168.1.10"))
+	assert.Equal(t, http.StatusForbidden, status(http.MethodPost, "/updates/", "10.0.0.1"))
+	assert.Equal(t, http.StatusForbidden, status(http.MethodPost, "/update/counter/c/1", "not an ip"))
+	assert.Equal(t, http.StatusForbidden, status(http.MethodPost, "/updates/", ""))
+	assert.Equal(t, http.StatusOK, status(http.MethodGet, "/value/counter/c", "10.0.0.1"))
+	assert.Equal(t, http.StatusForbidden, statusOf(directServ, http.MethodPost, "/updates/", "192.168.1.10"),
+		"only a trusted proxy may name the client")
+}
+
+func TestReplay(t *testing.T) {
+	_ = logger.InitLogger()
+	h := New(service.New(memory.New("", 0)), `key`)
+	testServ := httptest.NewServer(h.InitRoutes())
+	defer testServ.Close()
+
+	status := func(signed map[string]string) int {
+		req, err := http.NewRequest(http.MethodPost, testServ.URL+"/update/counter/PollCount/1", nil)
+		require.NoError(t, err)
+		for k, v := range signed {
+			req.Header.Set(k, v)
+		}
+		resp, err := testServ.Client().Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	signed := hash.Headers(nil, []byte(`key`))
+	assert.Equal(t, http.StatusOK, status(signed))
+	assert.Equal(t, http.StatusBadRequest, status(signed), "replayed request")
+
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	nonce := "fresh-nonce"
+	assert.Equal(t, http.StatusBadRequest, status(map[string]string{
+		hash.Header:    hash.Sign(nil, old, nonce, []byte(`key`)),
+		hash.Timestamp: old,
+		hash.Nonce:     nonce,
+	}), "timestamp outside the window")
+
+	tampered := hash.Headers(nil, []byte(`key`))
+	tampered[hash.Nonce] = "other-nonce"
+	assert.Equal(t, http.StatusBadRequest, status(tampered), "nonce not covered by the signature")
+
+	value, err := h.service.GetMetricValue(context.Background(), models.CounterType, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, "1", value)
+
+	h.SetReplayWindow(time.Minute, 1)
+	assert.Equal(t, http.StatusOK, status(hash.Headers(nil, []byte(`key`))))
+	assert.Equal(t, http.StatusServiceUnavailable, status(hash.Headers(nil, []byte(`key`))),
+		"a full nonce cache refuses new requests")
+}
+
+func TestKeyRotation(t *testing.T) {
+	_ = logger.InitLogger()
+	path := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"primary":"old","keys":{"old":"k1"}}`), 0600))
+	keys, err := hash.LoadKeyring(path)
+	require.NoError(t, err)
+	h := New(service.New(memory.New("", 0)), ``)
+	h.SetKeyring(keys)
+	testServ := httptest.NewServer(h.InitRoutes())
+	defer testServ.Close()
+
+	do := func(keyID, key string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, testServ.URL+"/update/counter/c/1", nil)
+		require.NoError(t, err)
+		for k, v := range hash.Headers(nil, []byte(key)) {
+			req.Header.Set(k, v)
+		}
+		if keyID != "" {
+			req.Header.Set(hash.KeyID, keyID)
+		}
+		resp, err := testServ.Client().Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp
+	}
+
+	assert.Equal(t, http.StatusOK, do("", "k1").StatusCode, "no key ID selects the primary key")
+	assert.Equal(t, http.StatusBadRequest, do("new", "k2").StatusCode)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"primary":"new","keys":{"old":"k1","new":"k2"}}`), 0600))
+	require.NoError(t, keys.Reload(path))
+	assert.Equal(t, http.StatusOK, do("old", "k1").StatusCode)
+	resp := do("new", "k2")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "new", resp.Header.Get(hash.KeyID))
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"primary":"new","keys":{"new":"k2"}}`), 0600))
+	require.NoError(t, keys.Reload(path))
+	assert.Equal(t, http.StatusBadRequest, do("old", "k1").StatusCode, "retired key")
+	assert.Equal(t, http.StatusOK, do("", "k2").StatusCode)
+}
+
+func TestResponseSigning(t *testing.T) {
+	_ = logger.InitLogger()
+	h := New(service.New(memory.New("", 0)), `key`)
+	h.SetStrictSigning(true)
+	testServ := httptest.NewServer(h.InitRoutes())
+	defer testServ.Close()
+
+	do := func(method, path, body string, signed bool) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, testServ.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if signed {
+			for k, v := range hash.Headers([]byte(body), []byte(`key`)) {
+				req.Header.Set(k, v)
+			}
+		}
+		resp, err := testServ.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		buf, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, buf
+	}
+
+	resp, _ := do(http.MethodPost, "/update/", `{"id":"g","type":"gauge","value":1.5}`, false)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "unsigned write in strict mode")
+
+	resp, body := do(http.MethodPost, "/update/", `{"id":"g","type":"gauge","value":1.5}`, true)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"id":"g","type":"gauge","value":1.5}`, string(body))
+	assert.Equal(t, hash.Encode(body, []byte(`key`)), resp.Header.Get(hash.Header))
+
+	resp, body = do(http.MethodPost, "/value/", `{"id":"g","type":"gauge"}`, false)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "reads need no signature")
+	assert.Equal(t, hash.Encode(body, []byte(`key`)), resp.Header.Get(hash.Header))
+
+	req, err := http.NewRequest(http.MethodGet, testServ.URL+"/value/gauge/g", nil)
+	require.NoError(t, err)
+	req.Header.Set(headers.AcceptEncoding, "gzip")
+	resp, err = testServ.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "gzip", resp.Header.Get(headers.ContentEncoding))
+	assert.Equal(t, hash.Encode([]byte("1.5"), []byte(`key`)), resp.Header.Get(hash.Header),
+		"the uncompressed body is signed")
+}
+
+func TestLimits(t *testing.T) {
+	_ = logger.InitLogger()
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	h := New(service.New(memory.New("", 0)), ``)
+	h.SetLimits(1024, 2, ratelimit.New(1, 2))
+	h.SetTrustedProxies([]*net.IPNet{loopback})
+	testServ := httptest.NewServer(h.InitRoutes())
+	defer testServ.Close()
+	direct := New(service.New(memory.New("", 0)), ``)
+	direct.SetLimits(1024, 2, ratelimit.New(1, 2))
+	directServ := httptest.NewServer(direct.InitRoutes())
+	defer directServ.Close()
+
+	postTo := func(ts *httptest.Server, realIP string, body []byte, gzipped bool) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/updates/", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set(headers.XRealIP, realIP)
+		if gzipped {
+			req.Header.Set(headers.ContentEncoding, "gzip")
+		}
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp
+	}
+	post := func(realIP string, body []byte, gzipped bool) *http.Response {
+		return postTo(testServ, realIP, body, gzipped)
+	}
+
+	batch := []byte(`[{"id":"c","type":"counter","delta":1}]`)
+	assert.Equal(t, http.StatusOK, post("10.0.0.1", batch, false).StatusCode)
+	assert.Equal(t, http.StatusOK, post("10.0.0.1", batch, false).StatusCode)
+	resp := post("10.0.0.1", batch, false)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get(headers.RetryAfter))
+	assert.Equal(t, http.StatusOK, post("10.0.0.2", batch, false).StatusCode, "agents are limited separately")
+	assert.Equal(t, http.StatusOK, postTo(directServ, "10.0.1.1", batch, false).StatusCode)
+	assert.Equal(t, http.StatusOK, postTo(directServ, "10.0.1.2", batch, false).StatusCode)
+	assert.Equal(t, http.StatusTooManyRequests, postTo(directServ, "10.0.1.3", batch, false).StatusCode,
+		"the address only a trusted proxy may name")
+
+	tenants, err := tenant.NewRegistry([]tenant.Tenant{{ID: "a", Token: "ta"}, {ID: "b", Token: "tb"}})
+	require.NoError(t, err)
+	shared := New(service.New(memory.New("", 0)), ``)
+	shared.SetLimits(1024, 2, ratelimit.New(1, 1))
+	shared.SetTenants(tenants)
+	sharedServ := httptest.NewServer(shared.InitRoutes())
+	defer sharedServ.Close()
+	postAs := func(token, agent string) int {
+		req, err := http.NewRequest(http.MethodPost, sharedServ.URL+"/updates/", bytes.NewReader(batch))
+		require.NoError(t, err)
+		req.Header.Set(headers.Authorization, "Bearer "+token)
+		req.Header.Set(models.AgentHeader, agent)
+		resp, err := sharedServ.Client().Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, postAs("ta", "x"))
+	assert.Equal(t, http.StatusTooManyRequests, postAs("ta", "x"))
+	assert.Equal(t, http.StatusOK, postAs("ta", "y"), "agents of a tenant are limited separately")
+	assert.Equal(t, http.StatusOK, postAs("tb", "x"), "agents are limited within their tenant")
+
+	large := []byte(`[{"id":"` + strings.Repeat("c", 2048) + `","type":"counter","delta":1}]`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post("10.0.0.3", large, false).StatusCode)
+
+	var bomb bytes.Buffer
+	gz := gzip.NewWriter(&bomb)
+	_, err = gz.Write(large)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	require.Less(t, bomb.Len(), 1024)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post("10.0.0.4", bomb.Bytes(), true).StatusCode,
+		"the decompressed size is limited too")
+
+	three := []byte(`[{"id":"a","type":"counter","delta":1},{"id":"b","type":"counter","delta":1},` +
+		`{"id":"c","type":"counter","delta":1}]`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post("10.0.0.5", three, false).StatusCode)
+}
+
+func TestHandleUpdatesPartial(t *testing.T) {
+	_ = logger.InitLogger()
+	h := New(service.New(memory.New("", 0)), ``)
+	testServ := httptest.NewServer(h.InitRoutes())
+	defer testServ.Close()
+
+	batch := `[{"id":"c","type":"counter","delta":1},{"id":"g","type":"gauge"},` +
+		`{"id":"h","type":"histogram","value":1},{"id":"v","type":"gauge","value":2.5}]`
+	post := func(partial bool) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodPost, testServ.URL+"/updates/", strings.NewReader(batch))
+		require.NoError(t, err)
+		if partial {
+			req.Header.Set(models.PartialHeader, "true")
+		}
+		resp, err := testServ.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, body
+	}
+
+	resp, _ := post(false)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	_, err := h.service.Get(context.Background(), models.CounterType, "c")
+	assert.Error(t, err, "without opting in the whole batch is rejected")
+
+	resp, body := post(true)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var report models.BatchReport
+	require.NoError(t, json.Unmarshal(body, &report))
+	assert.Equal(t, 2, report.Accepted)
+	require.Len(t, report.Rejected, 2)
+	assert.Equal(t, 1, report.Rejected[0].Index)
+	assert.Equal(t, "g", report.Rejected[0].ID)
+	assert.Equal(t, 2, report.Rejected[1].Index)
+	assert.Equal(t, service.ErrUnknownMetricType.Error(), report.Rejected[1].Reason)
+
+	value, err := h.service.GetMetricValue(context.Background(), models.GaugeType, "v")
+	require.NoError(t, err)
+	assert.Equal(t, "2.5", value)
+}
+
+func TestErrors(t *testing.T) {
+	_ = logger.InitLogger()
+	tokens, err := auth.NewFileStore(filepath.Join(t.TempDir(), "tokens.json"))
+	require.NoError(t, err)
+	reader, _, err := auth.Issue(context.Background(), tokens, []string{auth.ScopeRead}, "")
+	require.NoError(t, err)
+	writer, _, err := auth.Issue(context.Background(), tokens, []string{auth.ScopeWrite}, "")
+	require.NoError(t, err)
+	h := New(service.New(memory.New("", 0)), ``)
+	h.SetTokens(tokens)
+	testServ := httptest.NewServer(h.InitRoutes())
+	defer testServ.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		accept string
+		token  string
+		code   int
+		want   models.Error
+		plain  string
+	}{
+		{
+			name: "missing delta", method: http.MethodPost, path: "/update/", token: writer,
+			body: `{"id":"c","type":"counter"}`, code: http.StatusBadRequest,
+			want: models.Error{Code: "delta_undefined", Message: "delta undefined for metric type counter", Field: "delta"},
+		},
+		{
+			name: "missing scope", method: http.MethodPost, path: "/update/", token: reader,
+			body: `{"id":"c","type":"counter"}`, code: http.StatusForbidden,
+			want: models.Error{Code: "forbidden", Message: "token lacks the required scope write"},
+		},
+		{
+			name: "no token", method: http.MethodPost, path: "/value/",
+			body: `{"id":"c","type":"counter"}`, code: http.StatusUnauthorized,
+			want: models.Error{Code: "unauthorized", Message: ErrUnauthorized.Error()},
+		},
+		{
+			name: "unknown type", method: http.MethodPost, path: "/value/", token: reader,
+			body: `{"id":"c","type":"histogram"}`, code: http.StatusBadRequest,
+			want: models.Error{Code: "unknown_type", Message: service.ErrUnknownMetricType.Error(), Field: "type"},
+		},
+		{
+			name: "not found", method: http.MethodPost, path: "/value/", token: reader,
+			body: `{"id":"c","type":"counter"}`, code: http.StatusNotFound,
+			want: models.Error{Code: "not_found", Message: "value by counter type and c name: metric not found"},
+		},
+		{
+			name: "malformed body", method: http.MethodPost, path: "/value/", token: reader,
+			body: `{`, code: http.StatusBadRequest,
+			want: models.Error{Code: "bad_request", Message: "malformed request: unexpected end of JSON input"},
+		},
+		{
+			name: "non-finite gauge", method: http.MethodPost, path: "/update/gauge/g/NaN", token: writer,
+			accept: "application/json", code: http.StatusBadRequest,
+			want: models.Error{Code: "non_finite", Message: service.ErrNonFinite.Error(), Field: "value"},
+		},
+		{
+			name: "param route answers in plain text", method: http.MethodGet, path: "/value/counter/c", token: reader,
+			code: http.StatusNotFound, plain: "value by counter type and c name: metric not found\n",
+		},
+		{
+			name: "param route negotiates json", method: http.MethodGet, path: "/value/counter/c", token: reader,
+			accept: "application/json", code: http.StatusNotFound,
+			want: models.Error{Code: "not_found", Message: "value by counter type and c name: metric not found"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, testServ.URL+test.path, strings.NewReader(test.body))
+			require.NoError(t, err)
+			if test.accept != "" {
+				req.Header.Set(headers.Accept, test.accept)
+			}
+			if test.token != "" {
+				req.Header.Set(headers.Authorization, "Bearer "+test.token)
+			}
+			resp, err := testServ.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.code, resp.StatusCode)
+			if test.plain != "" {
+				assert.Equal(t, "text/plain", resp.Header.Get(headers.ContentType))
+				assert.Equal(t, test.plain, string(body))
+				return
+			}
+			assert.Equal(t, "application/json", resp.Header.Get(headers.ContentType))
+			var e models.Error
+			require.NoError(t, json.Unmarshal(body, &e))
+			assert.Equal(t, test.want, e)
+		})
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	_ = logger.InitLogger()
+	h := New(service.New(memory.New("", 0)), ``)
+	h.SetIdempotency(idempotency.NewCache(time.Minute, 100))
+	testServ := httptest.NewServer(h.InitRoutes())
+	defer testServ.Close()
+
+	post := func(key, body string) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodPost, testServ.URL+"/updates/", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set(idempotency.Header, key)
+		req.Header.Set(models.PartialHeader, "true")
+		resp, err := testServ.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		buf, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, buf
+	}
+	counter := func() string {
+		value, err := h.service.GetMetricValue(context.Background(), models.CounterType, "c")
+		require.NoError(t, err)
+		return value
+	}
+
+	batch := `[{"id":"c","type":"counter","delta":5},{"id":"g","type":"gauge"}]`
+	first, firstBody := post("k1", batch)
+	require.Equal(t, http.StatusOK, first.StatusCode)
+	assert.Empty(t, first.Header.Get(idempotency.ReplayedHeader))
+
+	retry, retryBody := post("k1", batch)
+	assert.Equal(t, http.StatusOK, retry.StatusCode)
+	assert.Equal(t, "true", retry.Header.Get(idempotency.ReplayedHeader))
+	assert.Equal(t, firstBody, retryBody, "the retry gets the original report")
+	assert.Equal(t, "5", counter(), "the retry is not applied again")
+
+	resp, _ := post("k2", batch)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "10", counter())
+
+	resp, _ = post("k3", `[`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = post("k3", batch)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "failures are not remembered")
+	assert.Empty(t, resp.Header.Get(idempotency.ReplayedHeader))
+	assert.Equal(t, "15", counter())
+}
+
+func TestCumulativeCounters(t *testing.T) {
+	_ = logger.InitLogger()
+	h := New(service.New(memory.New("", 0)), ``)
+	testServ := httptest.NewServer(h.InitRoutes())
+	defer testServ.Close()
+
+	report := func(agent string, total int) {
+		body := fmt.Sprintf(`[{"id":"PollCount","type":"counter","kind":"cumulative","delta":%d}]`, total)
+		req, err := http.NewRequest(http.MethodPost, testServ.URL+"/updates/", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set(models.AgentHeader, agent)
+		req.Header.Set(models.EpochHeader, strconv.FormatInt(time.Now().Unix(), 10))
+		resp, err := testServ.Client().Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	report("a", 3)
+	report("a", 7)
+	report("b", 2)
+	report("a", 1)
+
+	value, err := h.service.GetMetricValue(context.Background(), models.CounterType, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, "10", value)
+}
+
+func TestMetadata(t *testing.T) {
+	_ = logger.InitLogger()
+	T = template.Must(template.New("webpage").Parse(Tpl))
+	registry, err := metadata.NewRegistry([]metadata.Meta{{Name: "HeapAlloc", Type: models.GaugeType, Unit: "bytes"}})
+	require.NoError(t, err)
+	v := service.New(memory.New("", 0))
+	v.SetMetadata(registry)
+	h := New(v, ``)
+	testServ := httptest.NewServer(h.InitRoutes())
+	defer testServ.Close()
+
+	do := func(method, path, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, testServ.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := testServ.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		buf, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(buf)
+	}
+
+	resp, _ := do(http.MethodPost, "/metadata/",
+		`[{"name":"PollCount","type":"counter","description":"polls"},{"name":"HeapAlloc","description":"heap"}]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, body := do(http.MethodPost, "/metadata/", `[{"name":"HeapAlloc","type":"counter"}]`)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Contains(t, body, `"code":"type_conflict"`)
+
+	resp, body = do(http.MethodGet, "/metadata/", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var metas []metadata.Meta
+	require.NoError(t, json.Unmarshal([]byte(body), &metas))
+	assert.Equal(t, []metadata.Meta{
+		{Name: "HeapAlloc", Type: models.GaugeType, Unit: "bytes", Description: "heap"},
+		{Name: "PollCount", Type: models.CounterType, Description: "polls"},
+	}, metas)
+
+	resp, body = do(http.MethodPost, "/update/", `{"id":"HeapAlloc","type":"counter","delta":1}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "writes of another type than registered are refused")
+	assert.Contains(t, body, `"code":"type_conflict"`)
+	resp, _ = do(http.MethodPost, "/update/", `{"id":"HeapAlloc","type":"gauge","value":1024}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body = do(http.MethodGet, "/", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "HeapAlloc")
+	assert.Contains(t, body, "bytes")
+	assert.Contains(t, body, "<i>heap</i>")
+}
+
+// historian keeps one point of history for any metric asked about.
+type historian struct {
+	*memory.Storage
+	from, to time.Time
+}
+
+func (s *historian) History(_ context.Context, _, _ string, from, to time.Time) ([]models.Point, error) {
+	s.from, s.to = from, to
+	value := float64(1.5)
+	return []models.Point{{Time: from, Value: &value}}, nil
+}
+
+func TestHistory(t *testing.T) {
+	_ = logger.InitLogger()
+	r := &historian{Storage: memory.New("", 0)}
+	testServ := httptest.NewServer(New(service.New(r), ``).InitRoutes())
+	defer testServ.Close()
+	plainServ := httptest.NewServer(New(service.New(memory.New("", 0)), ``).InitRoutes())
+	defer plainServ.Close()
+
+	get := func(ts *httptest.Server, path string) (int, string) {
+		resp, err := ts.Client().Get(ts.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get(testServ, "/history/gauge/g?from=2024-01-01T00:00:00Z&to=2024-01-02T00:00:00Z")
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `[{"time":"2024-01-01T00:00:00Z","value":1.5}]`, body)
+	assert.Equal(t, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), r.to)
+
+	status, _ = get(testServ, "/history/gauge/g")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, historyWindow, r.to.Sub(r.from), "the last day by default")
+
+	status, body = get(testServ, "/history/gauge/g?from=yesterday")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, body, `"code":"bad_request"`)
+	status, body = get(testServ, "/history/histogram/g")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, body, `"code":"unknown_type"`)
+	status, body = get(plainServ, "/history/gauge/g")
+	assert.Equal(t, http.StatusNotImplemented, status)
+	assert.Contains(t, body, `"code":"no_history"`)
+}
@@ -3,26 +3,108 @@ package handler
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/hmac"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-http-utils/headers"
 
+	"github.com/dkrasnykh/metrics-alerter/internal/auth"
 	"github.com/dkrasnykh/metrics-alerter/internal/hash"
+	"github.com/dkrasnykh/metrics-alerter/internal/idempotency"
 	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+	"github.com/dkrasnykh/metrics-alerter/internal/tenant"
 )
 
+const maxIdempotencyKey = 255
+
 type CompressWriter struct {
 	http.ResponseWriter
 	Writer io.Writer
-	bytes  []byte
 }
 
 func (w CompressWriter) Write(b []byte) (int, error) {
-	w.bytes = b
-	return w.Writer.Write(w.bytes)
+	return w.Writer.Write(b)
+}
+
+func (w CompressWriter) Flush() {
+	if f, ok := w.Writer.(interface{ Flush() error }); ok {
+		logger.LogErrorIfNotNil(f.Flush())
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// SigningWriter holds the response back until the handler is done, so that
+// its signature can be sent in a header ahead of the body.
+type SigningWriter struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	streaming bool
+}
+
+func (w *SigningWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *SigningWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.streaming {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.body.Write(b)
+}
+
+// Flush turns the response into a stream, which is sent unsigned as it is
+// produced.
+func (w *SigningWriter) Flush() {
+	if !w.streaming {
+		w.streaming = true
+		w.send()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *SigningWriter) send() {
+	w.WriteHeader(http.StatusOK)
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(w.body.Bytes())
+	logger.LogErrorIfNotNil(err)
+}
+
+// RecordingWriter keeps a copy of the response as it is written.
+type RecordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *RecordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *RecordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
 }
 
 func (h *Handler) Logging(next http.Handler) http.Handler {
@@ -34,6 +116,221 @@ func (h *Handler) Logging(next http.Handler) http.Handler {
 	})
 }
 
+func (h *Handler) Writable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.service.ReadOnly() {
+			writeError(w, r, http.StatusServiceUnavailable, ErrReadOnly)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Authenticate resolves a bearer API token; a token bound to a tenant also
+// scopes the request to that tenant. Unknown tokens are left for Tenant,
+// which may recognize them as tenant tokens.
+func (h *Handler) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret, found := strings.CutPrefix(r.Header.Get(headers.Authorization), "Bearer ")
+		if h.tokens == nil || !found {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t, err := h.tokens.Find(r.Context(), auth.Hash(secret))
+		if errors.Is(err, auth.ErrNotFound) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		ctx := auth.NewContext(r.Context(), t)
+		if t.Tenant != "" {
+			// the token's tenant brings its key along, so signing is
+			// enforced just as for the tenant's own credentials
+			tn := tenant.Tenant{ID: t.Tenant}
+			if h.tenants != nil {
+				var ok bool
+				tn, ok = h.tenants.ByID(t.Tenant)
+				if !ok {
+					writeError(w, r, http.StatusUnauthorized, fmt.Errorf("%w %s", ErrUnknownTenant, t.Tenant))
+					return
+				}
+			}
+			ctx = tenant.NewContext(ctx, tn)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Require rejects requests without a token granting the scope: 401 when no
+// valid token was presented and 403 when it lacks the scope.
+func (h *Handler) Require(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if h.tokens == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			t, ok := auth.FromContext(r.Context())
+			if !ok {
+				writeError(w, r, http.StatusUnauthorized, ErrUnauthorized)
+				return
+			}
+			if !t.Allows(scope) {
+				writeError(w, r, http.StatusForbidden, fmt.Errorf("%w %s", ErrForbidden, scope))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Admin guards server-wide operations: they fail closed, not found without a
+// token store, and need an admin token not bound to a tenant.
+func (h *Handler) Admin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.tokens == nil {
+			writeError(w, r, http.StatusNotFound, ErrTokensDisabled)
+			return
+		}
+		t, ok := auth.FromContext(r.Context())
+		if !ok {
+			writeError(w, r, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+		if !t.Allows(auth.ScopeAdmin) || t.Tenant != "" {
+			writeError(w, r, http.StatusForbidden, fmt.Errorf("%w %s of no tenant", ErrForbidden, auth.ScopeAdmin))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Tenant authenticates the request either by a bearer token or by the
+// tenant header together with a body signed with that tenant's key; Hash
+// then checks the signature. A tenant already set by an API token is kept.
+func (h *Handler) Tenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := tenant.FromContext(r.Context()); ok || h.tenants == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var t tenant.Tenant
+		var ok bool
+		if token, found := strings.CutPrefix(r.Header.Get(headers.Authorization), "Bearer "); found {
+			t, ok = h.tenants.ByToken(token)
+		}
+		if id := r.Header.Get(tenant.Header); !ok && id != "" {
+			t, ok = h.tenants.ByID(id)
+			ok = ok && t.Key != "" && r.Header.Get(hash.Header) != ""
+		}
+		if !ok {
+			writeError(w, r, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(tenant.NewContext(r.Context(), t)))
+	})
+}
+
+// Trusted admits ingest only from the trusted subnets, judging by the
+// connection peer unless a trusted proxy names the client.
+func (h *Handler) Trusted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(h.trusted) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !contains(h.trusted, net.ParseIP(h.clientIP(r))) {
+			writeError(w, r, http.StatusForbidden, ErrUntrusted)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RateLimit throttles each agent of each tenant, so that agents sharing a
+// tenant or a token are not held back by one another, and tells it when to
+// retry.
+func (h *Handler) RateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := tenant.ID(r.Context()) + "/" + h.agentID(r)
+		ok, wait := h.limiter.Allow(key, time.Now())
+		if !ok {
+			w.Header().Set(headers.RetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, http.StatusTooManyRequests, ErrRateLimited)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Idempotent answers a retried write with the result of its first attempt
+// instead of applying it again. Only successful results are kept, since a
+// failed write changed nothing and may simply be retried.
+func (h *Handler) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotency.Header)
+		if h.idempotency == nil || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			writeError(w, r, http.StatusBadRequest,
+				fmt.Errorf("%w: idempotency key exceeds %d bytes", ErrBadRequest, maxIdempotencyKey))
+			return
+		}
+		key = tenant.ID(r.Context()) + " " + r.URL.Path + " " + key
+		unlock := h.locks.Lock(key)
+		defer unlock()
+
+		result, err := h.idempotency.Find(r.Context(), key)
+		if err == nil {
+			w.Header().Set(idempotency.ReplayedHeader, "true")
+			if result.ContentType != "" {
+				w.Header().Set(headers.ContentType, result.ContentType)
+			}
+			w.WriteHeader(result.Status)
+			_, err = w.Write(result.Body)
+			logger.LogErrorIfNotNil(err)
+			return
+		}
+		if !errors.Is(err, idempotency.ErrNotFound) {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		rw := &RecordingWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		if rw.status < http.StatusOK || rw.status >= http.StatusMultipleChoices {
+			return
+		}
+		err = h.idempotency.Save(r.Context(), key, idempotency.Result{
+			Status:      rw.status,
+			ContentType: w.Header().Get(headers.ContentType),
+			Body:        rw.body.Bytes(),
+			Created:     time.Now(),
+		})
+		logger.LogErrorIfNotNil(err)
+	})
+}
+
+// LimitBody caps the body as sent; GzipRequest caps it again once
+// decompressed.
+func (h *Handler) LimitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, h.maxBody)
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (h *Handler) GzipRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !strings.Contains(r.Header.Get(headers.ContentEncoding), "gzip") {
@@ -51,11 +348,10 @@ func (h *Handler) GzipRequest(next http.Handler) http.Handler {
 		}(oldBody)
 		zr, err := gzip.NewReader(oldBody)
 		if err != nil {
-			logger.Error(err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, r, http.StatusInternalServerError, err)
 			return
 		}
-		r.Body = zr
+		r.Body = http.MaxBytesReader(w, zr, h.maxBody)
 		next.ServeHTTP(w, r)
 	})
 }
@@ -68,8 +364,7 @@ func (h *Handler) GzipResponse(next http.Handler) http.Handler {
 		}
 		gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
 		if err != nil {
-			logger.Error(err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, r, http.StatusInternalServerError, err)
 			return
 		}
 		defer func(gz *gzip.Writer) {
@@ -85,28 +380,118 @@ func (h *Handler) GzipResponse(next http.Handler) http.Handler {
 	})
 }
 
+// Hash checks request signatures against the tenant's key or, for other
+// requests, the key named by the key-ID header, and signs the uncompressed
+// response body with the key signingKey returns.
 func (h *Handler) Hash(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get(hash.Header) != "" {
-			expected := r.Header.Get(hash.Header)
+			key, ok := h.verifyingKey(r)
+			if !ok {
+				writeError(w, r, http.StatusBadRequest, ErrUnknownKey)
+				return
+			}
 			buf, err := io.ReadAll(r.Body)
-			logger.LogErrorIfNotNil(err)
-			actual := hash.Encode(buf, []byte(h.key))
-			if expected != actual {
-				w.WriteHeader(http.StatusBadRequest)
+			if err != nil {
+				bodyError(w, r, err)
+				return
+			}
+			timestamp, nonce := r.Header.Get(hash.Timestamp), r.Header.Get(hash.Nonce)
+			expected := hash.Sign(buf, timestamp, nonce, []byte(key))
+			if !hmac.Equal([]byte(r.Header.Get(hash.Header)), []byte(expected)) {
+				writeError(w, r, http.StatusBadRequest, ErrBadSignature)
+				return
+			}
+			err = h.fresh(timestamp, nonce)
+			if errors.Is(err, hash.ErrNoncesFull) {
+				writeError(w, r, http.StatusServiceUnavailable, ErrReplayBusy)
+				return
+			}
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, ErrBadSignature)
 				return
 			}
 			r.Body = io.NopCloser(bytes.NewBuffer(buf))
 		}
 
-		next.ServeHTTP(w, r)
+		id, key := h.signingKey(r)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sw := &SigningWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.streaming {
+			return
+		}
+		if id != "" {
+			w.Header().Set(hash.KeyID, id)
+		}
+		w.Header().Set(hash.Header, hash.Encode(sw.body.Bytes(), []byte(key)))
+		sw.send()
+	})
+}
 
-		if h.key != "" {
-			writer, ok := w.(CompressWriter)
-			if ok {
-				value := hash.Encode(writer.bytes, []byte(h.key))
-				w.Header().Set(hash.Header, value)
+// Signed requires a signature on requests that have a key to be signed
+// with, when strict signing is on.
+func (h *Handler) Signed(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.strict && r.Header.Get(hash.Header) == "" {
+			if _, key := h.signingKey(r); key != "" {
+				writeError(w, r, http.StatusUnauthorized, ErrNotSigned)
+				return
 			}
 		}
+		next.ServeHTTP(w, r)
 	})
 }
+
+func (h *Handler) verifyingKey(r *http.Request) (string, bool) {
+	if t, ok := tenant.FromContext(r.Context()); ok && t.Key != "" {
+		return t.Key, true
+	}
+	return h.keys.Key(r.Header.Get(hash.KeyID))
+}
+
+// signingKey returns the key of the request's tenant or else the primary key,
+// with the ID to name it by.
+func (h *Handler) signingKey(r *http.Request) (string, string) {
+	if t, ok := tenant.FromContext(r.Context()); ok && t.Key != "" {
+		return "", t.Key
+	}
+	return h.keys.Primary()
+}
+
+// fresh accepts a signed request once, and only within the clock-skew window
+// around its timestamp.
+func (h *Handler) fresh(timestamp, nonce string) error {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || nonce == "" {
+		return ErrBadSignature
+	}
+	now := time.Now()
+	skew := now.Sub(time.Unix(sec, 0))
+	if skew > h.replayWindow || skew < -h.replayWindow {
+		return ErrBadSignature
+	}
+	return h.nonces.Add(nonce, now)
+}
+
+// clientIP is the connection peer, or the client a trusted proxy names in
+// X-Real-IP.
+func (h *Handler) clientIP(r *http.Request) string {
+	addr, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if real := r.Header.Get(headers.XRealIP); real != "" && contains(h.proxies, net.ParseIP(addr)) {
+		return real
+	}
+	return addr
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
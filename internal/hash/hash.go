@@ -2,14 +2,45 @@ package hash
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"time"
 )
 
-const Header = "HashSHA256"
+const (
+	Header    = "HashSHA256"
+	Timestamp = "X-Timestamp"
+	Nonce     = "X-Nonce"
+)
 
 func Encode(bytes []byte, key []byte) string {
 	h := hmac.New(sha256.New, key)
 	h.Write(bytes)
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
+
+// Sign binds the signature to the request timestamp and nonce as well as the
+// body, so that a captured request cannot be replayed later.
+func Sign(body []byte, timestamp, nonce string, key []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(timestamp + "\n" + nonce + "\n"))
+	h.Write(body)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Headers returns the signature, timestamp and nonce headers for a request
+// carrying the body.
+func Headers(body []byte, key []byte) map[string]string {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	nonce := hex.EncodeToString(buf)
+	return map[string]string{
+		Header:    Sign(body, timestamp, nonce, key),
+		Timestamp: timestamp,
+		Nonce:     nonce,
+	}
+}
@@ -0,0 +1,69 @@
+package hash
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSign(t *testing.T) {
+	h := Headers([]byte("body"), []byte("key"))
+	assert.Equal(t, Sign([]byte("body"), h[Timestamp], h[Nonce], []byte("key")), h[Header])
+	assert.NotEqual(t, Sign([]byte("body"), h[Timestamp], "other", []byte("key")), h[Header])
+	assert.NotEqual(t, h[Nonce], Headers([]byte("body"), []byte("key"))[Nonce])
+}
+
+func TestNonceCache(t *testing.T) {
+	now := time.Now()
+	c := NewNonceCache(time.Minute, 2)
+	assert.NoError(t, c.Add("a", now))
+	assert.ErrorIs(t, c.Add("a", now), ErrReplayed)
+	assert.NoError(t, c.Add("b", now))
+	assert.ErrorIs(t, c.Add("c", now), ErrNoncesFull, "live nonces are not evicted to make room")
+	assert.ErrorIs(t, c.Add("a", now), ErrReplayed, "a full cache still remembers its nonces")
+	assert.NoError(t, c.Add("c", now.Add(3*time.Minute)), "expired nonces make room")
+
+	c = NewNonceCache(time.Minute, 10)
+	assert.NoError(t, c.Add("a", now))
+	assert.NoError(t, c.Add("a", now.Add(3*time.Minute)), "expired nonces are forgotten")
+}
+
+func TestKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"primary":"k1","keys":{"k1":"one"}}`), 0600))
+	k, err := LoadKeyring(path)
+	require.NoError(t, err)
+
+	key, ok := k.Key("")
+	assert.True(t, ok)
+	assert.Equal(t, "one", key)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"primary":"k2","keys":{"k1":"one","k2":"two"}}`), 0600))
+	require.NoError(t, k.Reload(path))
+	id, key := k.Primary()
+	assert.Equal(t, "k2", id)
+	assert.Equal(t, "two", key)
+	key, ok = k.Key("k1")
+	assert.True(t, ok)
+	assert.Equal(t, "one", key)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"primary":"k3","keys":{"k2":"two"}}`), 0600))
+	assert.Error(t, k.Reload(path))
+	_, ok = k.Key("k1")
+	assert.True(t, ok, "an invalid file leaves the keys unchanged")
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"primary":"k2","keys":{"k2":"two"}}`), 0600))
+	require.NoError(t, k.Reload(path))
+	_, ok = k.Key("k1")
+	assert.False(t, ok, "retired key")
+
+	_, key = NewKeyring("").Primary()
+	assert.Empty(t, key)
+	key, ok = NewKeyring("legacy").Key("")
+	assert.True(t, ok)
+	assert.Equal(t, "legacy", key)
+}
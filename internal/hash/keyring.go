@@ -0,0 +1,86 @@
+package hash
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const KeyID = "X-Key-ID"
+
+// Keyring holds the keys requests may be signed with, each under its own ID,
+// and the primary one the server signs with. Keys can be swapped at runtime
+// so agents can be rolled over to a new key one by one.
+type Keyring struct {
+	primary string
+	keys    map[string]string
+	mx      sync.RWMutex
+}
+
+type keyringFile struct {
+	Primary string            `json:"primary"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// NewKeyring returns a keyring with the single key under the empty ID, which
+// is what agents that send no key ID are checked against.
+func NewKeyring(key string) *Keyring {
+	keys := map[string]string{}
+	if key != "" {
+		keys[""] = key
+	}
+	return &Keyring{keys: keys}
+}
+
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{}
+	err := k.Reload(path)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload replaces the keys with the ones in the file and keeps the current
+// keys if the file is invalid.
+func (k *Keyring) Reload(path string) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading keys from file %s: %w", path, err)
+	}
+	var f keyringFile
+	err = json.Unmarshal(buf, &f)
+	if err != nil {
+		return fmt.Errorf("error parsing keys file %s: %w", path, err)
+	}
+	if _, ok := f.Keys[f.Primary]; !ok {
+		return fmt.Errorf("primary key %q is not in keys file %s", f.Primary, path)
+	}
+	k.mx.Lock()
+	defer k.mx.Unlock()
+
+	k.primary, k.keys = f.Primary, f.Keys
+	return nil
+}
+
+// Key returns the key for the ID; an empty ID selects the primary key.
+func (k *Keyring) Key(id string) (string, bool) {
+	k.mx.RLock()
+	defer k.mx.RUnlock()
+
+	if id == "" {
+		id = k.primary
+	}
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// Primary returns the ID and key responses are signed with; the key is empty
+// when nothing is configured.
+func (k *Keyring) Primary() (string, string) {
+	k.mx.RLock()
+	defer k.mx.RUnlock()
+
+	return k.primary, k.keys[k.primary]
+}
@@ -0,0 +1,63 @@
+package hash
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrReplayed   = errors.New("nonce was already used")
+	ErrNoncesFull = errors.New("nonce cache is full")
+)
+
+type nonceEntry struct {
+	nonce string
+	seen  time.Time
+}
+
+// NonceCache remembers nonces for the length of the clock-skew window; a
+// nonce older than that is refused by the timestamp check anyway. Once full
+// of nonces still inside the window, new ones are refused rather than older
+// ones forgotten, since a forgotten nonce could be replayed.
+type NonceCache struct {
+	window time.Duration
+	size   int
+	seen   map[string]*list.Element
+	order  *list.List
+	mx     sync.Mutex
+}
+
+func NewNonceCache(window time.Duration, size int) *NonceCache {
+	return &NonceCache{
+		window: window,
+		size:   size,
+		seen:   make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// Add records the nonce. It returns ErrReplayed when the nonce was already
+// seen and ErrNoncesFull when there is no room for it.
+func (c *NonceCache) Add(nonce string, now time.Time) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		entry := e.Value.(nonceEntry)
+		if now.Sub(entry.seen) <= 2*c.window {
+			break
+		}
+		delete(c.seen, entry.nonce)
+		c.order.Remove(e)
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return ErrReplayed
+	}
+	if c.order.Len() >= c.size {
+		return ErrNoncesFull
+	}
+	c.seen[nonce] = c.order.PushBack(nonceEntry{nonce, now})
+	return nil
+}
@@ -0,0 +1,118 @@
+package idempotency
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	// Header carries the key a client gives a write; retries of the same
+	// write reuse it.
+	Header = "Idempotency-Key"
+	// ReplayedHeader marks a response repeated from an earlier request.
+	ReplayedHeader = "Idempotency-Replayed"
+
+	stripes = 64
+)
+
+var ErrNotFound = errors.New("idempotency key not found")
+
+// Result is the response to the first request made with a key.
+type Result struct {
+	Status      int       `json:"status"`
+	ContentType string    `json:"content_type"`
+	Body        []byte    `json:"body"`
+	Created     time.Time `json:"created"`
+}
+
+type Store interface {
+	Find(ctx context.Context, key string) (Result, error)
+	Save(ctx context.Context, key string, r Result) error
+}
+
+// NewKey returns a random key for a new write.
+func NewKey() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Locks serializes requests sharing a key, so that a retry arriving while
+// the first attempt is still being applied waits for its result.
+type Locks struct {
+	mx [stripes]sync.Mutex
+}
+
+func (l *Locks) Lock(key string) func() {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	mx := &l.mx[h.Sum32()%stripes]
+	mx.Lock()
+	return mx.Unlock
+}
+
+type entry struct {
+	key    string
+	result Result
+}
+
+// Cache keeps results in memory for ttl. Once full, the oldest results are
+// forgotten first.
+type Cache struct {
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+	mx      sync.Mutex
+}
+
+func NewCache(ttl time.Duration, size int) *Cache {
+	return &Cache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *Cache) Find(_ context.Context, key string) (Result, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+	e, ok := c.entries[key]
+	if !ok || now.Sub(e.Value.(entry).result.Created) > c.ttl {
+		return Result{}, ErrNotFound
+	}
+	return e.Value.(entry).result, nil
+}
+
+func (c *Cache) Save(_ context.Context, key string, r Result) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.order.Remove(e)
+	}
+	c.entries[key] = c.order.PushBack(entry{key, r})
+	c.expire(time.Now())
+	return nil
+}
+
+func (c *Cache) expire(now time.Time) {
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		en := e.Value.(entry)
+		if now.Sub(en.result.Created) <= c.ttl && c.order.Len() <= c.size {
+			break
+		}
+		delete(c.entries, en.key)
+		c.order.Remove(e)
+	}
+}
@@ -0,0 +1,34 @@
+package idempotency
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	c := NewCache(time.Minute, 2)
+
+	_, err := c.Find(ctx, "a")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, c.Save(ctx, "a", Result{Status: 200, Body: []byte("a"), Created: time.Now()}))
+	r, err := c.Find(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a"), r.Body)
+
+	require.NoError(t, c.Save(ctx, "b", Result{Status: 200, Created: time.Now()}))
+	require.NoError(t, c.Save(ctx, "c", Result{Status: 200, Created: time.Now()}))
+	_, err = c.Find(ctx, "a")
+	assert.ErrorIs(t, err, ErrNotFound, "the oldest key is forgotten once full")
+
+	require.NoError(t, c.Save(ctx, "d", Result{Status: 200, Created: time.Now().Add(-2 * time.Minute)}))
+	_, err = c.Find(ctx, "d")
+	assert.ErrorIs(t, err, ErrNotFound, "expired keys are forgotten")
+	_, err = c.Find(ctx, "c")
+	assert.NoError(t, err)
+}
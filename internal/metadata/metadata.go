@@ -0,0 +1,147 @@
+package metadata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+)
+
+var ErrTypeConflict = errors.New("metric type conflicts with its registered type")
+
+// Meta describes a metric name. Empty fields are unknown.
+type Meta struct {
+	Name        string `json:"name"`
+	Type        string `json:"type,omitempty"`
+	Unit        string `json:"unit,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type key struct {
+	tenant string
+	name   string
+}
+
+// Registry holds metadata from the registry file, which applies to every
+// tenant and cannot be overridden, and metadata sent by agents, which is kept
+// per tenant and fills in what the file leaves out.
+type Registry struct {
+	fixed map[string]Meta
+	sent  map[key]Meta
+	mx    sync.RWMutex
+}
+
+func NewRegistry(fixed []Meta) (*Registry, error) {
+	r := &Registry{
+		fixed: make(map[string]Meta, len(fixed)),
+		sent:  make(map[key]Meta),
+	}
+	for _, m := range fixed {
+		err := check(m)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := r.fixed[m.Name]; ok {
+			return nil, fmt.Errorf("duplicate metadata for %s", m.Name)
+		}
+		r.fixed[m.Name] = m
+	}
+	return r, nil
+}
+
+func Load(path string) (*Registry, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata from file %s: %w", path, err)
+	}
+	v := struct {
+		Metrics []Meta `json:"metrics"`
+	}{}
+	err = json.Unmarshal(buf, &v)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing metadata file %s: %w", path, err)
+	}
+	return NewRegistry(v.Metrics)
+}
+
+// Set records metadata sent for the tenant; a type other than the one in the
+// registry file is refused.
+func (r *Registry) Set(tenant string, m Meta) error {
+	err := check(m)
+	if err != nil {
+		return err
+	}
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if f, ok := r.fixed[m.Name]; ok && f.Type != "" && m.Type != "" && f.Type != m.Type {
+		return fmt.Errorf("%w: %s is registered as %s", ErrTypeConflict, m.Name, f.Type)
+	}
+	r.sent[key{tenant, m.Name}] = m
+	return nil
+}
+
+func (r *Registry) Get(tenant, name string) (Meta, bool) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	return r.get(tenant, name)
+}
+
+// All returns the metadata visible to the tenant, sorted by name.
+func (r *Registry) All(tenant string) []Meta {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	names := make(map[string]bool)
+	for name := range r.fixed {
+		names[name] = true
+	}
+	for k := range r.sent {
+		if k.tenant == tenant {
+			names[k.name] = true
+		}
+	}
+	all := make([]Meta, 0, len(names))
+	for name := range names {
+		m, _ := r.get(tenant, name)
+		all = append(all, m)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+func (r *Registry) get(tenant, name string) (Meta, bool) {
+	m, sent := r.sent[key{tenant, name}]
+	f, fixed := r.fixed[name]
+	if !fixed {
+		return m, sent
+	}
+	m.Name = name
+	if f.Type != "" {
+		m.Type = f.Type
+	}
+	if f.Unit != "" {
+		m.Unit = f.Unit
+	}
+	if f.Description != "" {
+		m.Description = f.Description
+	}
+	return m, true
+}
+
+func check(m Meta) error {
+	if m.Name == "" {
+		return errors.New("metadata name is empty")
+	}
+	switch m.Type {
+	case "", models.GaugeType, models.CounterType:
+		return nil
+	default:
+		return fmt.Errorf("metadata for %s has unknown metric type %s", m.Name, m.Type)
+	}
+}
@@ -0,0 +1,41 @@
+package metadata
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+)
+
+func TestRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	require.NoError(t, os.WriteFile(path,
+		[]byte(`{"metrics":[{"name":"HeapAlloc","type":"gauge","unit":"bytes"}]}`), 0666))
+	r, err := Load(path)
+	require.NoError(t, err)
+
+	m, ok := r.Get("", "HeapAlloc")
+	require.True(t, ok)
+	assert.Equal(t, Meta{Name: "HeapAlloc", Type: models.GaugeType, Unit: "bytes"}, m)
+
+	err = r.Set("a", Meta{Name: "HeapAlloc", Type: models.CounterType})
+	assert.ErrorIs(t, err, ErrTypeConflict)
+	require.NoError(t, r.Set("a", Meta{Name: "HeapAlloc", Unit: "B", Description: "heap in use"}))
+	m, _ = r.Get("a", "HeapAlloc")
+	assert.Equal(t, Meta{Name: "HeapAlloc", Type: models.GaugeType, Unit: "bytes", Description: "heap in use"}, m,
+		"the file wins where it says something")
+
+	require.NoError(t, r.Set("a", Meta{Name: "PollCount", Type: models.CounterType}))
+	_, ok = r.Get("b", "PollCount")
+	assert.False(t, ok, "sent metadata is kept per tenant")
+	assert.Len(t, r.All("a"), 2)
+	assert.Len(t, r.All("b"), 1)
+
+	assert.Error(t, r.Set("a", Meta{Name: "x", Type: "histogram"}))
+	_, err = NewRegistry([]Meta{{Name: "x"}, {Name: "x"}})
+	assert.Error(t, err)
+}
@@ -1,13 +1,64 @@
 package models
 
+import "time"
+
 const (
 	GaugeType   string = "gauge"
 	CounterType string = "counter"
 )
 
+// A counter sample is a delta to add unless its kind says it is the
+// cumulative total the agent has counted since it started.
+const (
+	DeltaKind      string = "delta"
+	CumulativeKind string = "cumulative"
+)
+
+// AgentHeader names the agent; cumulative totals are tracked per agent.
+const AgentHeader = "X-Agent-ID"
+
+// EpochHeader carries the agent's start time in Unix seconds; totals of a new
+// epoch count from zero.
+const EpochHeader = "X-Agent-Epoch"
+
 type Metrics struct {
 	ID    string   `json:"id"`
 	MType string   `json:"type"`
+	Kind  string   `json:"kind,omitempty"`
 	Delta *int64   `json:"delta,omitempty"`
 	Value *float64 `json:"value,omitempty"`
+	Stale bool     `json:"stale,omitempty"`
+}
+
+// PartialHeader opts a batch into partial success: valid metrics are stored
+// and the rest reported back in a BatchReport.
+const PartialHeader = "X-Partial-Success"
+
+type BatchReport struct {
+	Accepted int        `json:"accepted"`
+	Rejected []Rejected `json:"rejected"`
+}
+
+type Rejected struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// Point is a metric's value at a time. A counter's delta is its running
+// total, and a rolled-up point carries the last total of its bucket, so
+// totals are not to be summed; a gauge's rolled-up value is its bucket
+// average.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Delta *int64    `json:"delta,omitempty"`
+	Value *float64  `json:"value,omitempty"`
+}
+
+// Error is the body of every API error response; Field names the offending
+// metric field when there is one.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
 }
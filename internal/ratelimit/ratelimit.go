@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// maxIdle bounds how many buckets are kept before full ones, which behave
+// exactly like fresh buckets, are dropped.
+const maxIdle = 10000
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a token bucket per key: each key may make burst requests at
+// once and rate requests per second on average.
+type Limiter struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	mx      sync.Mutex
+}
+
+func New(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token for the key, or reports how long to wait for one.
+func (l *Limiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxIdle {
+			l.sweep(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / l.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllow(t *testing.T) {
+	now := time.Now()
+	l := New(2, 3)
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("a", now)
+		assert.True(t, ok)
+	}
+	ok, wait := l.Allow("a", now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	ok, _ = l.Allow("b", now)
+	assert.True(t, ok, "keys have their own buckets")
+
+	ok, _ = l.Allow("a", now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+	ok, _ = l.Allow("a", now.Add(500*time.Millisecond))
+	assert.False(t, ok)
+}
+
+func TestSweep(t *testing.T) {
+	now := time.Now()
+	l := New(1, 1)
+	l.Allow("a", now)
+	l.Allow("b", now.Add(time.Second))
+	l.sweep(now.Add(time.Second))
+	assert.Len(t, l.buckets, 1)
+	assert.Contains(t, l.buckets, "b")
+}
@@ -0,0 +1,378 @@
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"github.com/go-resty/resty/v2"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/hash"
+	"github.com/dkrasnykh/metrics-alerter/internal/idempotency"
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/tenant"
+)
+
+const (
+	queueSize      = 100
+	spoolSuffix    = ".json.gz"
+	rejectedDir    = "rejected"
+	defaultTimeout = 10 * time.Second
+)
+
+// statusError is an answer of the upstream other than 200.
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf(`unexpected status code %d`, e.code)
+}
+
+// retryable reports whether a failed batch may go through later: network
+// errors, server errors and rate limiting pass, other client errors will not.
+func retryable(err error) bool {
+	var se *statusError
+	if !errors.As(err, &se) {
+		return true
+	}
+	return se.code >= http.StatusInternalServerError ||
+		se.code == http.StatusTooManyRequests || se.code == http.StatusRequestTimeout
+}
+
+type Config struct {
+	Upstream  string
+	Key       string
+	KeyID     string
+	Token     string
+	Aggregate bool
+	Interval  time.Duration
+	Timeout   time.Duration
+	SpoolDir  string
+	Tenants   *tenant.Registry
+}
+
+type key struct {
+	Tenant string
+	MType  string
+	ID     string
+}
+
+// batch is what goes upstream in one request; metrics of different tenants
+// never share a batch. Its idempotency key is made when it is first sent and
+// kept in the spool, so an upstream that applied a batch whose answer was
+// lost does not apply it again.
+type batch struct {
+	tenant  string
+	metrics []models.Metrics
+	key     string
+}
+
+type Relay struct {
+	c       Config
+	client  *resty.Client
+	queue   chan batch
+	pending map[key]models.Metrics
+	mx      sync.Mutex
+	sendMx  sync.Mutex
+	spoolMx sync.Mutex
+}
+
+func New(c Config) (*Relay, error) {
+	if c.SpoolDir != "" {
+		err := os.MkdirAll(c.SpoolDir, 0777)
+		if err != nil {
+			return nil, err
+		}
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Relay{
+		c:       c,
+		client:  resty.New().SetTimeout(timeout),
+		queue:   make(chan batch, queueSize),
+		pending: make(map[key]models.Metrics),
+	}, nil
+}
+
+func (r *Relay) Forward(ctx context.Context, metrics []models.Metrics) {
+	id := tenant.ID(ctx)
+	if r.c.Aggregate {
+		r.mx.Lock()
+		defer r.mx.Unlock()
+
+		for _, m := range metrics {
+			k := key{id, m.MType, m.ID}
+			if p, ok := r.pending[k]; ok && m.MType == models.CounterType {
+				delta := *p.Delta + *m.Delta
+				m.Delta = &delta
+			}
+			r.pending[k] = m
+		}
+		return
+	}
+	select {
+	case r.queue <- batch{tenant: id, metrics: metrics}:
+	default:
+		logger.Error("relay queue is full, spooling batch")
+		logger.LogErrorIfNotNil(r.spool(batch{tenant: id, metrics: metrics}))
+	}
+}
+
+func (r *Relay) Run(ctx context.Context) {
+	interval := r.c.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// a stopped relay keeps what is queued rather than send it, however
+		// the select below would choose
+		if ctx.Err() != nil {
+			r.drain()
+			return
+		}
+		select {
+		case <-ctx.Done():
+			r.drain()
+			return
+		case b := <-r.queue:
+			r.deliver(b)
+		case <-ticker.C:
+			r.Flush()
+		}
+	}
+}
+
+func (r *Relay) Flush() {
+	byTenant := r.take()
+	if len(byTenant) == 0 {
+		r.deliver(batch{})
+	}
+	for id, metrics := range byTenant {
+		r.deliver(batch{tenant: id, metrics: metrics})
+	}
+}
+
+// drain keeps whatever the relay still holds when it stops: spooled to be
+// sent on the next start or, without a spool, sent at once.
+func (r *Relay) drain() {
+	keep := r.deliver
+	if r.c.SpoolDir != "" {
+		keep = func(b batch) {
+			logger.LogErrorIfNotNil(r.spool(b))
+		}
+	}
+	for len(r.queue) > 0 {
+		keep(<-r.queue)
+	}
+	for id, metrics := range r.take() {
+		keep(batch{tenant: id, metrics: metrics})
+	}
+}
+
+// take empties the pending aggregates, grouped by tenant.
+func (r *Relay) take() map[string][]models.Metrics {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	byTenant := make(map[string][]models.Metrics)
+	for k, m := range r.pending {
+		byTenant[k.Tenant] = append(byTenant[k.Tenant], m)
+	}
+	r.pending = make(map[key]models.Metrics)
+	return byTenant
+}
+
+// deliver keeps batches in order: once anything is spooled, new batches are
+// queued behind it until the spool has drained. A batch the upstream rejects
+// for good is dropped, or moved aside from the spool, so it cannot hold up
+// the ones behind it.
+func (r *Relay) deliver(b batch) {
+	r.sendMx.Lock()
+	defer r.sendMx.Unlock()
+
+	spooled, err := r.spooled()
+	logger.LogErrorIfNotNil(err)
+	if len(b.metrics) > 0 {
+		if b.key == "" {
+			b.key = idempotency.NewKey()
+		}
+		if len(spooled) == 0 {
+			err = r.send(b)
+			if err == nil {
+				return
+			}
+			logger.Error(fmt.Sprintf("relay to %s: %s", r.c.Upstream, err.Error()))
+			if !retryable(err) {
+				logger.Error(fmt.Sprintf("relay dropped %d rejected metrics", len(b.metrics)))
+				return
+			}
+		}
+		logger.LogErrorIfNotNil(r.spool(b))
+		spooled, err = r.spooled()
+		logger.LogErrorIfNotNil(err)
+	}
+	for _, path := range spooled {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		id, key := spooledBatch(path)
+		err = r.post(id, key, buf)
+		if err != nil && retryable(err) {
+			return
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("relay to %s rejected %s: %s", r.c.Upstream, path, err.Error()))
+			logger.LogErrorIfNotNil(r.reject(path))
+			continue
+		}
+		logger.LogErrorIfNotNil(os.Remove(path))
+	}
+}
+
+// reject moves a spooled batch the upstream will not accept out of the way,
+// keeping it for inspection.
+func (r *Relay) reject(path string) error {
+	dir := filepath.Join(r.c.SpoolDir, rejectedDir)
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path, filepath.Join(dir, filepath.Base(path)))
+}
+
+func (r *Relay) send(b batch) error {
+	buf, err := encode(b.metrics)
+	if err != nil {
+		return err
+	}
+	return r.post(b.tenant, b.key, buf)
+}
+
+// post signs the batch with the tenant's own key when the relay knows it and
+// falls back to the relay key otherwise.
+func (r *Relay) post(id, idempotencyKey string, buf []byte) error {
+	req := r.client.R().SetHeader(headers.ContentType, `application/json`).
+		SetHeader(headers.ContentEncoding, `gzip`)
+	if idempotencyKey != "" {
+		req.SetHeader(idempotency.Header, idempotencyKey)
+	}
+	key, keyID := r.c.Key, r.c.KeyID
+	if id != "" {
+		req.SetHeader(tenant.Header, id)
+		if r.c.Tenants != nil {
+			if t, ok := r.c.Tenants.ByID(id); ok && t.Key != "" {
+				key, keyID = t.Key, ""
+			}
+		}
+	}
+	if key != "" {
+		req.SetHeaders(hash.Headers(buf, []byte(key)))
+	}
+	if keyID != "" {
+		req.SetHeader(hash.KeyID, keyID)
+	}
+	if r.c.Token != "" {
+		req.SetAuthToken(r.c.Token)
+	}
+	resp, err := req.SetBody(buf).Post(fmt.Sprintf("http://%s/updates/", r.c.Upstream))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return &statusError{resp.StatusCode()}
+	}
+	return nil
+}
+
+// spool takes only the spool lock, so that Forward never waits for a send
+// in progress.
+func (r *Relay) spool(b batch) error {
+	if r.c.SpoolDir == "" {
+		return fmt.Errorf("relay spool is not configured, dropping %d metrics", len(b.metrics))
+	}
+	buf, err := encode(b.metrics)
+	if err != nil {
+		return err
+	}
+	if b.key == "" {
+		b.key = idempotency.NewKey()
+	}
+	r.spoolMx.Lock()
+	defer r.spoolMx.Unlock()
+
+	name := fmt.Sprintf("%020d.%s", time.Now().UnixNano(), b.key)
+	if b.tenant != "" {
+		name += "_" + url.PathEscape(b.tenant)
+	}
+	path := filepath.Join(r.c.SpoolDir, name+spoolSuffix)
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, buf, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (r *Relay) spooled() ([]string, error) {
+	if r.c.SpoolDir == "" {
+		return nil, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(r.c.SpoolDir, "*"+spoolSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// spooledBatch reads the tenant and idempotency key off a spool file name;
+// files spooled before keys were kept have none.
+func spooledBatch(path string) (string, string) {
+	name := strings.TrimSuffix(filepath.Base(path), spoolSuffix)
+	head, escaped, ok := strings.Cut(name, "_")
+	_, key, _ := strings.Cut(head, ".")
+	if !ok {
+		return "", key
+	}
+	id, err := url.PathUnescape(escaped)
+	logger.LogErrorIfNotNil(err)
+	return id, key
+}
+
+func encode(batch []models.Metrics) ([]byte, error) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	_, err = gz.Write(body)
+	if err != nil {
+		return nil, err
+	}
+	err = gz.Close()
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
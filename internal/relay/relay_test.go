@@ -0,0 +1,250 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/handler"
+	"github.com/dkrasnykh/metrics-alerter/internal/idempotency"
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/service"
+	"github.com/dkrasnykh/metrics-alerter/internal/storage/memory"
+	"github.com/dkrasnykh/metrics-alerter/internal/tenant"
+)
+
+type upstream struct {
+	service  *service.Service
+	server   *httptest.Server
+	down     atomic.Bool
+	lose     atomic.Bool
+	requests atomic.Int64
+}
+
+func newUpstream(t *testing.T, key string, tenants ...tenant.Tenant) *upstream {
+	u := &upstream{service: service.New(memory.New("", 0))}
+	h := handler.New(u.service, key)
+	h.SetIdempotency(idempotency.NewCache(time.Hour, 100))
+	if len(tenants) > 0 {
+		r, err := tenant.NewRegistry(tenants)
+		require.NoError(t, err)
+		h.SetTenants(r)
+	}
+	routes := h.InitRoutes()
+	u.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u.down.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		u.requests.Add(1)
+		if u.lose.Load() {
+			// the batch is applied but its answer never arrives
+			routes.ServeHTTP(httptest.NewRecorder(), r)
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		routes.ServeHTTP(w, r)
+	}))
+	t.Cleanup(u.server.Close)
+	return u
+}
+
+func (u *upstream) address() string {
+	return strings.TrimPrefix(u.server.URL, "http://")
+}
+
+func (u *upstream) value(mType, name string) string {
+	value, _ := u.service.GetMetricValue(context.Background(), mType, name)
+	return value
+}
+
+func counter(name string, delta int64) models.Metrics {
+	return models.Metrics{MType: models.CounterType, ID: name, Delta: &delta}
+}
+
+func TestForward(t *testing.T) {
+	_ = logger.InitLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	u := newUpstream(t, "secret")
+	r, err := New(Config{Upstream: u.address(), Key: "secret", Interval: time.Hour})
+	require.NoError(t, err)
+	go r.Run(ctx)
+
+	r.Forward(ctx, []models.Metrics{counter("c", 5)})
+	r.Forward(ctx, []models.Metrics{counter("c", 7)})
+	require.Eventually(t, func() bool { return u.value(models.CounterType, "c") == "12" },
+		3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(2), u.requests.Load())
+}
+
+func TestAggregate(t *testing.T) {
+	_ = logger.InitLogger()
+	u := newUpstream(t, "")
+	r, err := New(Config{Upstream: u.address(), Aggregate: true})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	v1, v2 := float64(1), float64(2)
+	r.Forward(ctx, []models.Metrics{counter("c", 5), {MType: models.GaugeType, ID: "g", Value: &v1}})
+	r.Forward(ctx, []models.Metrics{counter("c", 7), {MType: models.GaugeType, ID: "g", Value: &v2}})
+	r.Flush()
+
+	assert.Equal(t, int64(1), u.requests.Load())
+	assert.Equal(t, "12", u.value(models.CounterType, "c"))
+	assert.Equal(t, "2", u.value(models.GaugeType, "g"))
+}
+
+func TestSpool(t *testing.T) {
+	_ = logger.InitLogger()
+	u := newUpstream(t, "")
+	dir := t.TempDir()
+	r, err := New(Config{Upstream: u.address(), SpoolDir: dir})
+	require.NoError(t, err)
+
+	u.down.Store(true)
+	r.deliver(batch{metrics: []models.Metrics{counter("c", 5)}})
+	r.deliver(batch{metrics: []models.Metrics{counter("c", 7)}})
+	spooled, err := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	require.NoError(t, err)
+	assert.Len(t, spooled, 2)
+
+	u.down.Store(false)
+	r.Flush()
+	spooled, err = filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	require.NoError(t, err)
+	assert.Empty(t, spooled)
+	assert.Equal(t, "12", u.value(models.CounterType, "c"))
+}
+
+func TestTenantSpool(t *testing.T) {
+	_ = logger.InitLogger()
+	tenants := []tenant.Tenant{{ID: "a/1", Key: "ka"}, {ID: "b", Key: "kb"}}
+	u := newUpstream(t, "", tenants...)
+	registry, err := tenant.NewRegistry(tenants)
+	require.NoError(t, err)
+	r, err := New(Config{Upstream: u.address(), SpoolDir: t.TempDir(), Tenants: registry})
+	require.NoError(t, err)
+
+	u.down.Store(true)
+	r.Forward(tenant.WithID(context.Background(), "a/1"), []models.Metrics{counter("c", 5)})
+	r.Forward(tenant.WithID(context.Background(), "b"), []models.Metrics{counter("c", 7)})
+	r.deliver(<-r.queue)
+	r.deliver(<-r.queue)
+
+	u.down.Store(false)
+	r.Flush()
+	ctx := context.Background()
+	value, err := u.service.GetMetricValue(tenant.WithID(ctx, "a/1"), models.CounterType, "c")
+	require.NoError(t, err)
+	assert.Equal(t, "5", value)
+	value, err = u.service.GetMetricValue(tenant.WithID(ctx, "b"), models.CounterType, "c")
+	require.NoError(t, err)
+	assert.Equal(t, "7", value)
+}
+
+func TestStalledUpstream(t *testing.T) {
+	_ = logger.InitLogger()
+	release := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer stalled.Close()
+	defer close(release)
+	dir := t.TempDir()
+	r, err := New(Config{Upstream: strings.TrimPrefix(stalled.URL, "http://"), SpoolDir: dir, Timeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+
+	r.sendMx.Lock()
+	for i := 0; i <= queueSize; i++ {
+		r.Forward(context.Background(), []models.Metrics{counter("c", 1)})
+	}
+	r.sendMx.Unlock()
+	spooled, err := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	require.NoError(t, err)
+	assert.Len(t, spooled, 1, "a full queue spools without waiting for a send")
+
+	delivered := make(chan struct{})
+	go func() {
+		r.deliver(<-r.queue)
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the send did not time out")
+	}
+}
+
+func TestRejectedSpool(t *testing.T) {
+	_ = logger.InitLogger()
+	u := newUpstream(t, "")
+	dir := t.TempDir()
+	r, err := New(Config{Upstream: u.address(), SpoolDir: dir})
+	require.NoError(t, err)
+
+	poison := filepath.Join(dir, fmt.Sprintf("%020d", 1)+spoolSuffix)
+	buf, err := encode([]models.Metrics{{MType: "histogram", ID: "h"}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(poison, buf, 0666))
+	require.NoError(t, r.spool(batch{metrics: []models.Metrics{counter("c", 5)}}))
+
+	r.Flush()
+	assert.Equal(t, "5", u.value(models.CounterType, "c"), "a rejected batch does not hold up the spool")
+	spooled, err := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	require.NoError(t, err)
+	assert.Empty(t, spooled)
+	assert.FileExists(t, filepath.Join(dir, rejectedDir, filepath.Base(poison)))
+}
+
+func TestDrain(t *testing.T) {
+	_ = logger.InitLogger()
+	u := newUpstream(t, "")
+	dir := t.TempDir()
+	r, err := New(Config{Upstream: u.address(), SpoolDir: dir})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r.Forward(ctx, []models.Metrics{counter("c", 5)})
+	r.Forward(ctx, []models.Metrics{counter("c", 7)})
+	r.Run(ctx)
+	spooled, err := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	require.NoError(t, err)
+	assert.Len(t, spooled, 2, "what is queued on shutdown is spooled")
+	assert.Zero(t, u.requests.Load())
+
+	r.Flush()
+	assert.Equal(t, "12", u.value(models.CounterType, "c"))
+}
+
+func TestLostResponse(t *testing.T) {
+	_ = logger.InitLogger()
+	u := newUpstream(t, "")
+	dir := t.TempDir()
+	r, err := New(Config{Upstream: u.address(), SpoolDir: dir})
+	require.NoError(t, err)
+
+	u.lose.Store(true)
+	r.deliver(batch{metrics: []models.Metrics{counter("c", 5)}})
+	spooled, err := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	require.NoError(t, err)
+	require.Len(t, spooled, 1)
+	_, key := spooledBatch(spooled[0])
+	assert.NotEmpty(t, key, "the spool keeps the batch's idempotency key")
+
+	u.lose.Store(false)
+	r.Flush()
+	assert.Equal(t, "5", u.value(models.CounterType, "c"), "the retry is not applied twice")
+}
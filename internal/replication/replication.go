@@ -0,0 +1,168 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-http-utils/headers"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+)
+
+const (
+	OpSnapshot = "snapshot"
+	OpSave     = "save"
+	OpLoad     = "load"
+
+	StreamPath = "/replication/stream"
+
+	bufferSize     = 1024
+	reconnectDelay = time.Second
+)
+
+type Event struct {
+	Op      string           `json:"op"`
+	Tenant  string           `json:"tenant,omitempty"`
+	Metrics []models.Metrics `json:"metrics"`
+}
+
+type Hub struct {
+	subscribers map[chan Event]struct{}
+	closed      bool
+	mx          sync.Mutex
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[chan Event]struct{})}
+}
+
+func (h *Hub) Subscribe() chan Event {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	ch := make(chan Event, bufferSize)
+	if h.closed {
+		close(ch)
+		return ch
+	}
+	h.subscribers[ch] = struct{}{}
+	return ch
+}
+
+// Close ends every stream, as on shutdown; later subscribers get a closed
+// stream at once.
+func (h *Hub) Close() {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	h.closed = true
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (h *Hub) Unsubscribe(ch chan Event) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	if _, ok := h.subscribers[ch]; ok {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Publish never blocks the write path: a follower that falls a whole buffer
+// behind is disconnected and resynchronizes from a fresh snapshot.
+func (h *Hub) Publish(e Event) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+			logger.Error("replication subscriber is too slow, disconnecting")
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+type Applier interface {
+	Apply(ctx context.Context, e Event) error
+}
+
+type Follower struct {
+	leader string
+	token  string
+	a      Applier
+	client *http.Client
+}
+
+// NewFollower connects with the given admin token when the leader requires
+// token authentication; an empty token sends none.
+func NewFollower(leader, token string, a Applier) *Follower {
+	return &Follower{
+		leader: leader,
+		token:  token,
+		a:      a,
+		client: &http.Client{},
+	}
+}
+
+func (f *Follower) Run(ctx context.Context) {
+	for {
+		err := f.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("replication from %s: %s", f.leader, err.Error()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func (f *Follower) follow(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s%s", f.leader, StreamPath), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(headers.AcceptEncoding, "identity")
+	if f.token != "" {
+		req.Header.Set(headers.Authorization, "Bearer "+f.token)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := resp.Body.Close()
+		logger.LogErrorIfNotNil(err)
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e Event
+		err = dec.Decode(&e)
+		if err != nil {
+			return err
+		}
+		err = f.a.Apply(ctx, e)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package replication_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/auth"
+	"github.com/dkrasnykh/metrics-alerter/internal/handler"
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/replication"
+	"github.com/dkrasnykh/metrics-alerter/internal/service"
+	"github.com/dkrasnykh/metrics-alerter/internal/storage/memory"
+)
+
+func newServer(t *testing.T, tokens auth.Store) (*service.Service, *httptest.Server) {
+	v := service.New(memory.New("", 0))
+	v.EnableReplication(replication.NewHub())
+	h := handler.New(v, ``)
+	if tokens != nil {
+		h.SetTokens(tokens)
+	}
+	ts := httptest.NewServer(h.InitRoutes())
+	t.Cleanup(ts.Close)
+	return v, ts
+}
+
+func post(t *testing.T, ts *httptest.Server, path, token string) int {
+	req, err := http.NewRequest(http.MethodPost, ts.URL+path, nil)
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set(headers.Authorization, "Bearer "+token)
+	}
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return resp.StatusCode
+}
+
+func value(v *service.Service, mType, name string) string {
+	value, _ := v.GetMetricValue(context.Background(), mType, name)
+	return value
+}
+
+func TestReplication(t *testing.T) {
+	_ = logger.InitLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tokens, err := auth.NewFileStore(filepath.Join(t.TempDir(), "tokens.json"))
+	require.NoError(t, err)
+	admin, _, err := auth.Issue(ctx, tokens, []string{auth.ScopeAdmin}, "")
+	require.NoError(t, err)
+	writer, _, err := auth.Issue(ctx, tokens, []string{auth.ScopeWrite}, "")
+	require.NoError(t, err)
+	tenantAdmin, _, err := auth.Issue(ctx, tokens, []string{auth.ScopeAdmin}, "a")
+	require.NoError(t, err)
+
+	leader, leaderServ := newServer(t, tokens)
+	delta := int64(5)
+	_, err = leader.Save(ctx, models.Metrics{MType: models.CounterType, ID: "c", Delta: &delta})
+	require.NoError(t, err)
+
+	follower, followerServ := newServer(t, tokens)
+	follower.Follow(ctx, strings.TrimPrefix(leaderServ.URL, "http://"), admin)
+
+	require.Eventually(t, func() bool { return value(follower, models.CounterType, "c") == "5" },
+		3*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, http.StatusOK, post(t, leaderServ, "/update/counter/c/10", writer))
+	assert.Equal(t, http.StatusOK, post(t, leaderServ, "/update/gauge/g/1.5", writer))
+	v := float64(2.5)
+	err = leader.Load(ctx, []models.Metrics{
+		{MType: models.CounterType, ID: "c", Delta: &delta},
+		{MType: models.GaugeType, ID: "h", Value: &v},
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return value(follower, models.CounterType, "c") == "20" &&
+			value(follower, models.GaugeType, "g") == "1.5" &&
+			value(follower, models.GaugeType, "h") == "2.5"
+	}, 3*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, http.StatusServiceUnavailable, post(t, followerServ, "/update/counter/c/1", writer))
+	assert.Equal(t, http.StatusUnauthorized, post(t, followerServ, "/replication/promote", ""))
+	assert.Equal(t, http.StatusForbidden, post(t, followerServ, "/replication/promote", writer))
+	assert.Equal(t, http.StatusForbidden, post(t, followerServ, "/replication/promote", tenantAdmin),
+		"a tenant admin cannot act on the whole server")
+	assert.Equal(t, http.StatusConflict, post(t, leaderServ, "/replication/promote", admin))
+	assert.Equal(t, http.StatusOK, post(t, followerServ, "/replication/promote", admin))
+	assert.Equal(t, http.StatusOK, post(t, followerServ, "/update/counter/c/1", writer))
+	assert.Equal(t, "21", value(follower, models.CounterType, "c"))
+
+	assert.Equal(t, http.StatusOK, post(t, leaderServ, "/update/counter/c/100", writer))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "21", value(follower, models.CounterType, "c"))
+}
+
+func TestAdminRoutesNeedTokenStore(t *testing.T) {
+	_ = logger.InitLogger()
+	_, ts := newServer(t, nil)
+	assert.Equal(t, http.StatusNotFound, post(t, ts, "/replication/promote", ""))
+	resp, err := ts.Client().Get(ts.URL + replication.StreamPath)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestClose(t *testing.T) {
+	h := replication.NewHub()
+	ch := h.Subscribe()
+	h.Close()
+	_, ok := <-ch
+	assert.False(t, ok, "streams end on close")
+	_, ok = <-h.Subscribe()
+	assert.False(t, ok)
+	h.Publish(replication.Event{Op: replication.OpSave})
+}
+
+func TestSlowSubscriberIsDisconnected(t *testing.T) {
+	_ = logger.InitLogger()
+	h := replication.NewHub()
+	ch := h.Subscribe()
+	for i := 0; i < 2000; i++ {
+		h.Publish(replication.Event{Op: replication.OpSave})
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	assert.Less(t, n, 2000)
+	h.Unsubscribe(ch)
+}
@@ -2,14 +2,29 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"github.com/dkrasnykh/metrics-alerter/internal/models"
 )
 
+// ErrNotFound is returned by Get when the metric does not exist.
+var ErrNotFound = errors.New("metric not found")
+
+// ErrNoHistory is returned by History when the storage keeps no history.
+var ErrNoHistory = errors.New("storage keeps no metric history")
+
 type Storager interface {
 	Create(ctx context.Context, metric models.Metrics) (models.Metrics, error)
+	Increment(ctx context.Context, name string, delta int64) (models.Metrics, error)
 	Get(ctx context.Context, mType, name string) (models.Metrics, error)
 	GetAll(ctx context.Context) ([]models.Metrics, error)
 	Load(ctx context.Context, metrics []models.Metrics) error
 	Ping(ctx context.Context) error
+	Purge(ctx context.Context, mType string, before time.Time) error
+}
+
+// Historian is a storage that keeps past values of metrics.
+type Historian interface {
+	History(ctx context.Context, mType, name string, from, to time.Time) ([]models.Point, error)
 }
@@ -1,15 +1,31 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"html/template"
+	"io"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 
 	"github.com/dkrasnykh/metrics-alerter/internal/config"
 	"github.com/dkrasnykh/metrics-alerter/internal/handler"
+	"github.com/dkrasnykh/metrics-alerter/internal/hash"
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+	"github.com/dkrasnykh/metrics-alerter/internal/metadata"
+	"github.com/dkrasnykh/metrics-alerter/internal/ratelimit"
+	"github.com/dkrasnykh/metrics-alerter/internal/relay"
+	"github.com/dkrasnykh/metrics-alerter/internal/replication"
+	"github.com/dkrasnykh/metrics-alerter/internal/repository"
 	"github.com/dkrasnykh/metrics-alerter/internal/service"
 	"github.com/dkrasnykh/metrics-alerter/internal/storage"
+	"github.com/dkrasnykh/metrics-alerter/internal/tenant"
 )
 
 type Server struct {
@@ -24,19 +40,174 @@ func New(conf *config.ServerConfig) *Server {
 	}
 }
 
+// Run serves until SIGINT or SIGTERM, then finishes the requests in flight,
+// keeps what the relay still holds and closes the storage.
 func (s *Server) Run() error {
-	var err error
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	r, err := storage.New(s.c)
 	if err != nil {
 		return err
 	}
+	defer closeStorage(r)
+	janitorDone := make(chan struct{})
+	go func() {
+		defer close(janitorDone)
+		storage.RunJanitor(ctx, r, s.c.TTL(),
+			time.Duration(s.c.StaleRetention)*time.Second, time.Duration(s.c.JanitorInterval)*time.Second)
+	}()
+	defer func() {
+		stop()
+		<-janitorDone
+	}()
+	keys, err := s.c.Keyring()
+	if err != nil {
+		return err
+	}
+	if s.c.KeysFile != "" {
+		go s.reloadKeys(keys)
+	}
+	trusted, err := s.c.TrustedNets()
+	if err != nil {
+		return err
+	}
+	proxies, err := s.c.ProxyNets()
+	if err != nil {
+		return err
+	}
+	tokens, err := storage.NewTokens(s.c, r)
+	if err != nil {
+		return err
+	}
+	if tokens == nil && (s.c.Replication || s.c.ReplicaOf != "") {
+		return errors.New("replication requires a token store for its admin endpoints")
+	}
+	results, err := storage.NewIdempotency(s.c, r)
+	if err != nil {
+		return err
+	}
+	var tenants *tenant.Registry
+	if s.c.TenantsFile != "" {
+		tenants, err = tenant.Load(s.c.TenantsFile)
+		if err != nil {
+			return err
+		}
+	}
+	policy, err := service.NewPolicy(s.c.NamePattern, s.c.MaxNameLength, s.c.Types(), s.c.Prefixes(),
+		s.c.AllowNonFinite, s.c.AllowNegativeDelta)
+	if err != nil {
+		return err
+	}
 	v := service.New(r)
+	v.SetPolicy(policy)
+	v.SetCursorTTL(time.Duration(s.c.AgentTTL) * time.Second)
+	if s.c.MetadataFile != "" {
+		meta, err := metadata.Load(s.c.MetadataFile)
+		if err != nil {
+			return err
+		}
+		v.SetMetadata(meta)
+	}
+	if tenants != nil {
+		v.SetTenants(tenants.IDs())
+	}
+	var hub *replication.Hub
+	if s.c.Replication || s.c.ReplicaOf != "" {
+		hub = replication.NewHub()
+		v.EnableReplication(hub)
+	}
+	if s.c.ReplicaOf != "" {
+		v.Follow(ctx, s.c.ReplicaOf, s.c.ReplicaToken)
+	}
+	if s.c.Upstream != "" {
+		keyID, key := keys.Primary()
+		rl, err := relay.New(relay.Config{
+			Upstream:  s.c.Upstream,
+			Key:       key,
+			KeyID:     keyID,
+			Token:     s.c.UpstreamToken,
+			Aggregate: s.c.RelayAggregate,
+			Interval:  time.Duration(s.c.RelayInterval) * time.Second,
+			Timeout:   time.Duration(s.c.RelayTimeout) * time.Second,
+			SpoolDir:  s.c.RelaySpoolDir,
+			Tenants:   tenants,
+		})
+		if err != nil {
+			return err
+		}
+		// the relay outlives the requests in flight, which still forward to it
+		relayCtx, stopRelay := context.WithCancel(context.Background())
+		relayDone := make(chan struct{})
+		go func() {
+			defer close(relayDone)
+			rl.Run(relayCtx)
+		}()
+		defer func() {
+			stopRelay()
+			<-relayDone
+		}()
+		v.SetForwarder(rl)
+	}
 	handler.T, err = template.New("webpage").Parse(handler.Tpl)
 	if err != nil {
 		return err
 	}
 	h := handler.New(v, s.c.Key)
+	h.SetKeyring(keys)
+	h.SetStrictSigning(s.c.StrictSigning)
+	var limiter *ratelimit.Limiter
+	if s.c.IngestRate > 0 {
+		limiter = ratelimit.New(float64(s.c.IngestRate), s.c.IngestBurst)
+	}
+	h.SetLimits(s.c.MaxBodyBytes, s.c.MaxBatchSize, limiter)
+	h.SetTenants(tenants)
+	h.SetTrustedSubnets(trusted)
+	h.SetTrustedProxies(proxies)
+	h.SetReplayWindow(time.Duration(s.c.ReplayWindow)*time.Second, s.c.NonceCacheSize)
+	if tokens != nil {
+		h.SetTokens(tokens)
+	}
+	if results != nil {
+		h.SetIdempotency(results)
+	}
 
-	err = http.ListenAndServe(s.c.Address, h.InitRoutes())
-	return err
+	srv := &http.Server{Addr: s.c.Address, Handler: h.InitRoutes()}
+	if hub != nil {
+		srv.RegisterOnShutdown(hub.Close)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	select {
+	case err = <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	logger.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(s.c.ShutdownTimeout)*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+func closeStorage(r repository.Storager) {
+	if c, ok := r.(io.Closer); ok {
+		logger.LogErrorIfNotNil(c.Close())
+	}
+}
+
+// reloadKeys rereads the keys file on SIGHUP so keys can be added and retired
+// while agents are rolled over.
+func (s *Server) reloadKeys(keys *hash.Keyring) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		err := keys.Reload(s.c.KeysFile)
+		if err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+		logger.Info(fmt.Sprintf("signing keys reloaded from %s", s.c.KeysFile))
+	}
 }
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/tenant"
+)
+
+type agentKey struct{}
+
+type agentInfo struct {
+	id    string
+	epoch int64
+}
+
+// WithAgent names the agent the request comes from and the epoch, its start
+// time in Unix seconds, its totals count from; cumulative counters are
+// tracked per agent.
+func WithAgent(ctx context.Context, id string, epoch int64) context.Context {
+	return context.WithValue(ctx, agentKey{}, agentInfo{id, epoch})
+}
+
+func agent(ctx context.Context) agentInfo {
+	a, _ := ctx.Value(agentKey{}).(agentInfo)
+	return a
+}
+
+// cursor identifies a counter an agent reports as a cumulative total.
+type cursor struct {
+	tenant string
+	agent  string
+	id     string
+}
+
+// position is the last total an agent reported for a counter.
+type position struct {
+	epoch int64
+	total int64
+	seen  time.Time
+}
+
+// SetCursorTTL must be called before the service handles requests; cursors
+// of agents silent for longer are forgotten, 0 keeps them.
+func (s *Service) SetCursorTTL(ttl time.Duration) {
+	s.cursorTTL = ttl
+}
+
+// accumulate turns cumulative counter samples into deltas. Cursors are moved
+// on at once, so that concurrent reports of an agent count each increase
+// once, and done moves them back if the deltas could not be stored.
+func (s *Service) accumulate(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, func(stored bool)) {
+	cumulative := false
+	for _, m := range metrics {
+		cumulative = cumulative || m.Kind == models.CumulativeKind
+	}
+	if !cumulative {
+		return metrics, func(bool) {}
+	}
+
+	s.cursorMx.Lock()
+	defer s.cursorMx.Unlock()
+
+	now := time.Now()
+	s.expire(now)
+	out, prev, next := s.deltas(ctx, metrics, now)
+	for k, p := range next {
+		s.cursors[k] = p
+	}
+	return out, func(stored bool) {
+		if stored {
+			return
+		}
+		s.cursorMx.Lock()
+		defer s.cursorMx.Unlock()
+
+		for k, p := range next {
+			if s.cursors[k] != p {
+				// A later report moved the cursor on; its delta counts from
+				// this total, so the failed one is lost rather than counted
+				// twice.
+				continue
+			}
+			if last, ok := prev[k]; ok {
+				s.cursors[k] = last
+			} else {
+				delete(s.cursors, k)
+			}
+		}
+	}
+}
+
+// deltas takes the difference to the last total the agent reported in the
+// same epoch. A new epoch, or a lower total, means the agent restarted and
+// counts from zero again. The first total seen from an agent is taken whole
+// only if the agent started after the horizon, when the service started or
+// last forgot a cursor; otherwise, as after a server restart or once its
+// cursor expired, the total may have been counted already and only sets the
+// base for the next one.
+func (s *Service) deltas(ctx context.Context, metrics []models.Metrics, now time.Time) ([]models.Metrics, map[cursor]position, map[cursor]position) {
+	a := agent(ctx)
+	prev := make(map[cursor]position)
+	next := make(map[cursor]position)
+	out := make([]models.Metrics, len(metrics))
+	for i, m := range metrics {
+		if m.Kind != models.CumulativeKind {
+			out[i] = m
+			continue
+		}
+		k := cursor{tenant.ID(ctx), a.id, m.ID}
+		last, ok := next[k]
+		if !ok {
+			last, ok = s.cursors[k]
+			if ok {
+				prev[k] = last
+			}
+		}
+		total := *m.Delta
+		var delta int64
+		switch {
+		case !ok && a.epoch >= s.horizon.Unix():
+			delta = total
+		case !ok:
+		case last.epoch != a.epoch || total < last.total:
+			delta = total
+		default:
+			delta = total - last.total
+		}
+		next[k] = position{epoch: a.epoch, total: total, seen: now}
+		out[i] = models.Metrics{ID: m.ID, MType: m.MType, Delta: &delta}
+	}
+	return out, prev, next
+}
+
+// expire forgets cursors not reported for longer than the TTL, at most once
+// per TTL, and moves the horizon past them.
+func (s *Service) expire(now time.Time) {
+	if s.cursorTTL <= 0 || now.Sub(s.expired) < s.cursorTTL {
+		return
+	}
+	s.expired = now
+	for k, p := range s.cursors {
+		if now.Sub(p.seen) > s.cursorTTL {
+			delete(s.cursors, k)
+			if horizon := p.seen.Add(time.Second); horizon.After(s.horizon) {
+				s.horizon = horizon
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+)
+
+const DefaultMaxNameLength = 255
+
+var (
+	ErrNameTooLong     = errors.New("metric ID is too long")
+	ErrNameInvalid     = errors.New("metric ID is not allowed by the name pattern")
+	ErrNameReserved    = errors.New("metric ID has a reserved prefix")
+	ErrTypeNotAllowed  = errors.New("metric type is not allowed")
+	ErrNonFinite       = errors.New("gauge value is not finite")
+	ErrNegativeDelta   = errors.New("counter delta is negative")
+	defaultNamePattern = regexp.MustCompile(`^[^\p{Cc}]+$`)
+)
+
+// Policy is what Validate enforces on every ingested metric beyond its
+// shape.
+type Policy struct {
+	NamePattern         *regexp.Regexp
+	MaxNameLength       int
+	Types               []string
+	ReservedPrefixes    []string
+	AllowNonFinite      bool
+	AllowNegativeDeltas bool
+}
+
+// DefaultPolicy refuses control characters in names, names longer than
+// DefaultMaxNameLength, non-finite gauges and negative deltas.
+func DefaultPolicy() Policy {
+	return Policy{
+		NamePattern:   defaultNamePattern,
+		MaxNameLength: DefaultMaxNameLength,
+		Types:         []string{models.GaugeType, models.CounterType},
+	}
+}
+
+// NewPolicy builds a policy from its configured form; an empty pattern keeps
+// the default one.
+func NewPolicy(pattern string, maxLength int, types, reserved []string, nonFinite, negativeDeltas bool) (Policy, error) {
+	p := Policy{
+		NamePattern:         defaultNamePattern,
+		MaxNameLength:       maxLength,
+		Types:               types,
+		ReservedPrefixes:    reserved,
+		AllowNonFinite:      nonFinite,
+		AllowNegativeDeltas: negativeDeltas,
+	}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return Policy{}, fmt.Errorf("metric name pattern: %w", err)
+		}
+		p.NamePattern = re
+	}
+	for _, t := range types {
+		if t != models.GaugeType && t != models.CounterType {
+			return Policy{}, fmt.Errorf("%w %s", ErrUnknownMetricType, t)
+		}
+	}
+	return p, nil
+}
+
+func (p Policy) name(id string) error {
+	if p.MaxNameLength > 0 && len(id) > p.MaxNameLength {
+		return fmt.Errorf("%w: %d bytes, at most %d allowed", ErrNameTooLong, len(id), p.MaxNameLength)
+	}
+	if p.NamePattern != nil && !p.NamePattern.MatchString(id) {
+		return fmt.Errorf("%w %s", ErrNameInvalid, p.NamePattern.String())
+	}
+	for _, prefix := range p.ReservedPrefixes {
+		if strings.HasPrefix(id, prefix) {
+			return fmt.Errorf("%w %s", ErrNameReserved, prefix)
+		}
+	}
+	return nil
+}
+
+func (p Policy) allows(mType string) bool {
+	if len(p.Types) == 0 {
+		return true
+	}
+	for _, t := range p.Types {
+		if t == mType {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Policy) value(m models.Metrics) *FieldError {
+	switch {
+	case m.MType == models.GaugeType && !p.AllowNonFinite && (math.IsNaN(*m.Value) || math.IsInf(*m.Value, 0)):
+		return &FieldError{"value", ErrNonFinite}
+	case m.MType == models.CounterType && m.Kind != models.CumulativeKind && !p.AllowNegativeDeltas && *m.Delta < 0:
+		return &FieldError{"delta", ErrNegativeDelta}
+	}
+	return nil
+}
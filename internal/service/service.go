@@ -5,57 +5,176 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/dkrasnykh/metrics-alerter/internal/metadata"
 	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/replication"
 	"github.com/dkrasnykh/metrics-alerter/internal/repository"
+	"github.com/dkrasnykh/metrics-alerter/internal/tenant"
 )
 
 var ErrUnknownMetricType = errors.New("unknown metric type")
 var ErrIDIsEmpty = errors.New("metric ID is empty")
+var ErrValueUndefined = errors.New("value undefined")
+var ErrDeltaUndefined = errors.New("delta undefined")
+var ErrNotFound = repository.ErrNotFound
+var ErrNoHistory = repository.ErrNoHistory
+var ErrUnknownKind = errors.New("unknown sample kind")
+var ErrNegativeTotal = errors.New("cumulative total is negative")
+var ErrTypeConflict = metadata.ErrTypeConflict
+var ErrReplicationDisabled = errors.New("replication is disabled")
+var ErrNotFollower = errors.New("server is not a follower")
+
+// FieldError ties a validation error to the metric field that caused it.
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+type Forwarder interface {
+	Forward(ctx context.Context, metrics []models.Metrics)
+}
 
 type Service struct {
-	r repository.Storager
+	r        repository.Storager
+	hub      *replication.Hub
+	forward  Forwarder
+	readOnly atomic.Bool
+	unfollow context.CancelFunc
+	tenants  []string
+	// writes share mx while they store and publish, so concurrent writes of
+	// one gauge may reach followers in either order, as they may reach the
+	// storage; Subscribe takes it alone, so a snapshot sees none half done
+	mx       sync.RWMutex
+	followMx sync.Mutex
+
+	horizon   time.Time
+	cursors   map[cursor]position
+	cursorTTL time.Duration
+	expired   time.Time
+	cursorMx  sync.Mutex
+
+	policy Policy
+	meta   *metadata.Registry
 }
 
 func New(s repository.Storager) *Service {
-	return &Service{r: s}
+	meta, _ := metadata.NewRegistry(nil)
+	return &Service{
+		r:       s,
+		horizon: time.Now(),
+		cursors: make(map[cursor]position),
+		policy:  DefaultPolicy(),
+		meta:    meta,
+	}
+}
+
+// SetMetadata must be called before the service handles requests; it
+// replaces the empty registry New starts with.
+func (s *Service) SetMetadata(r *metadata.Registry) {
+	s.meta = r
+}
+
+// Describe records metadata an agent sent about its metrics.
+func (s *Service) Describe(ctx context.Context, metas []metadata.Meta) error {
+	for _, m := range metas {
+		err := s.meta.Set(tenant.ID(ctx), m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Service) Metadata(ctx context.Context) []metadata.Meta {
+	return s.meta.All(tenant.ID(ctx))
 }
 
-func (s *Service) Validate(m models.Metrics) error {
+func (s *Service) Meta(ctx context.Context, name string) (metadata.Meta, bool) {
+	return s.meta.Get(tenant.ID(ctx), name)
+}
+
+// SetPolicy must be called before the service handles requests.
+func (s *Service) SetPolicy(p Policy) {
+	s.policy = p
+}
+
+// Validate checks the metric's shape, its registered type and then the
+// policy; every ingest path validates through it.
+func (s *Service) Validate(ctx context.Context, m models.Metrics) error {
 	if m.ID == `` {
-		return ErrIDIsEmpty
+		return &FieldError{"id", ErrIDIsEmpty}
+	}
+	if err := s.policy.name(m.ID); err != nil {
+		return &FieldError{"id", err}
 	}
 	switch m.MType {
 	case models.GaugeType:
 		if m.Value == nil {
-			return fmt.Errorf(`value undefined for metric type %s`, m.MType)
+			return &FieldError{"value", fmt.Errorf(`%w for metric type %s`, ErrValueUndefined, m.MType)}
 		}
 	case models.CounterType:
 		if m.Delta == nil {
-			return fmt.Errorf(`delta undefined for metric type %s`, m.MType)
+			return &FieldError{"delta", fmt.Errorf(`%w for metric type %s`, ErrDeltaUndefined, m.MType)}
 		}
 	default:
-		return ErrUnknownMetricType
+		return &FieldError{"type", ErrUnknownMetricType}
+	}
+	switch m.Kind {
+	case ``, models.DeltaKind:
+	case models.CumulativeKind:
+		if m.MType != models.CounterType {
+			return &FieldError{"kind", fmt.Errorf(`%w %s for metric type %s`, ErrUnknownKind, m.Kind, m.MType)}
+		}
+		if *m.Delta < 0 {
+			return &FieldError{"delta", ErrNegativeTotal}
+		}
+	default:
+		return &FieldError{"kind", fmt.Errorf(`%w %s`, ErrUnknownKind, m.Kind)}
+	}
+	if meta, ok := s.meta.Get(tenant.ID(ctx), m.ID); ok && meta.Type != "" && meta.Type != m.MType {
+		return &FieldError{"type", fmt.Errorf(`%w: %s is registered as %s`, ErrTypeConflict, m.ID, meta.Type)}
+	}
+	if !s.policy.allows(m.MType) {
+		return &FieldError{"type", fmt.Errorf(`%w: %s`, ErrTypeNotAllowed, m.MType)}
+	}
+	if fe := s.policy.value(m); fe != nil {
+		return fe
 	}
 	return nil
 }
 
 func (s *Service) Save(ctx context.Context, m models.Metrics) (models.Metrics, error) {
-	if m.MType == models.CounterType {
-		delta := s.calculateCounterValue(ctx, m.ID, *m.Delta)
-		m.Delta = &delta
+	if s.hub != nil {
+		s.mx.RLock()
+		defer s.mx.RUnlock()
 	}
 
-	return s.r.Create(ctx, m)
-}
-
-func (s *Service) calculateCounterValue(ctx context.Context, name string, value int64) int64 {
-	metric, err := s.r.Get(ctx, models.CounterType, name)
-	if err != nil || metric.Delta == nil {
-		return value
+	ms, done := s.accumulate(ctx, []models.Metrics{m})
+	m = ms[0]
+	var saved models.Metrics
+	var err error
+	if m.MType == models.CounterType {
+		saved, err = s.r.Increment(ctx, m.ID, *m.Delta)
+	} else {
+		saved, err = s.r.Create(ctx, m)
+	}
+	done(err == nil)
+	if err == nil {
+		s.published(ctx, replication.Event{Op: replication.OpSave, Metrics: []models.Metrics{m}})
 	}
-	value += *metric.Delta
-	return value
+	return saved, err
 }
 
 func (s *Service) GetMetricValue(ctx context.Context, mType, mName string) (string, error) {
@@ -79,7 +198,26 @@ func (s *Service) Get(ctx context.Context, mType, mName string) (models.Metrics,
 	return s.r.Get(ctx, mType, mName)
 }
 
+// History returns the metric's points from the given time up to the other,
+// read alike from raw values and from their roll-ups.
+func (s *Service) History(ctx context.Context, mType, name string, from, to time.Time) ([]models.Point, error) {
+	if mType != models.GaugeType && mType != models.CounterType {
+		return nil, ErrUnknownMetricType
+	}
+	h, ok := s.r.(repository.Historian)
+	if !ok {
+		return nil, ErrNoHistory
+	}
+	return h.History(ctx, mType, name, from, to)
+}
+
 func (s *Service) Load(ctx context.Context, metrics []models.Metrics) error {
+	if s.hub != nil {
+		s.mx.RLock()
+		defer s.mx.RUnlock()
+	}
+
+	metrics, done := s.accumulate(ctx, metrics)
 	counters := map[string]int64{}
 	gauges := map[string]float64{}
 	for i := 0; i < len(metrics); i++ {
@@ -92,16 +230,132 @@ func (s *Service) Load(ctx context.Context, metrics []models.Metrics) error {
 		}
 	}
 	toSave := []models.Metrics{}
-	for name, value := range counters {
-		delta := s.calculateCounterValue(ctx, name, value)
+	for name, delta := range counters {
+		delta := delta
 		m := models.Metrics{MType: models.CounterType, ID: name, Delta: &delta}
 		toSave = append(toSave, m)
 	}
 	for name, value := range gauges {
+		value := value
 		m := models.Metrics{MType: models.GaugeType, ID: name, Value: &value}
 		toSave = append(toSave, m)
 	}
-	return s.r.Load(ctx, toSave)
+	err := s.r.Load(ctx, toSave)
+	done(err == nil)
+	if err == nil {
+		s.published(ctx, replication.Event{Op: replication.OpLoad, Metrics: toSave})
+	}
+	return err
+}
+
+func (s *Service) published(ctx context.Context, e replication.Event) {
+	e.Tenant = tenant.ID(ctx)
+	if s.hub != nil {
+		s.hub.Publish(e)
+	}
+	if s.forward != nil {
+		s.forward.Forward(ctx, e.Metrics)
+	}
+}
+
+// SetTenants must be called before the service handles requests; replication
+// snapshots cover the default namespace and each of the given tenants.
+func (s *Service) SetTenants(ids []string) {
+	s.tenants = ids
+}
+
+// SetForwarder must be called before the service handles requests.
+func (s *Service) SetForwarder(f Forwarder) {
+	s.forward = f
+}
+
+// EnableReplication must be called before the service handles requests.
+func (s *Service) EnableReplication(h *replication.Hub) {
+	s.hub = h
+}
+
+// Subscribe returns the current state together with a stream of every write
+// accepted after it; writes are held off meanwhile so none is missed or
+// counted twice.
+func (s *Service) Subscribe(ctx context.Context) ([]replication.Event, chan replication.Event, error) {
+	if s.hub == nil {
+		return nil, nil, ErrReplicationDisabled
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	ids := append([]string{""}, s.tenants...)
+	snapshot := make([]replication.Event, 0, len(ids))
+	for _, id := range ids {
+		metrics, err := s.r.GetAll(tenant.WithID(ctx, id))
+		if err != nil {
+			return nil, nil, err
+		}
+		snapshot = append(snapshot, replication.Event{Op: replication.OpSnapshot, Tenant: id, Metrics: metrics})
+	}
+	return snapshot, s.hub.Subscribe(), nil
+}
+
+func (s *Service) Unsubscribe(ch chan replication.Event) {
+	s.hub.Unsubscribe(ch)
+}
+
+func (s *Service) Apply(ctx context.Context, e replication.Event) error {
+	ctx = tenant.WithID(ctx, e.Tenant)
+	switch e.Op {
+	case replication.OpSnapshot:
+		if s.hub != nil {
+			s.mx.RLock()
+			defer s.mx.RUnlock()
+		}
+		for _, m := range e.Metrics {
+			_, err := s.r.Create(ctx, m)
+			if err != nil {
+				return err
+			}
+		}
+		if s.hub != nil {
+			s.hub.Publish(e)
+		}
+		return nil
+	case replication.OpSave:
+		for _, m := range e.Metrics {
+			_, err := s.Save(ctx, m)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case replication.OpLoad:
+		return s.Load(ctx, e.Metrics)
+	default:
+		return fmt.Errorf("unknown replication operation %s", e.Op)
+	}
+}
+
+func (s *Service) Follow(ctx context.Context, leader, token string) {
+	s.followMx.Lock()
+	defer s.followMx.Unlock()
+
+	ctx, s.unfollow = context.WithCancel(ctx)
+	s.readOnly.Store(true)
+	go replication.NewFollower(leader, token, s).Run(ctx)
+}
+
+func (s *Service) Promote() error {
+	s.followMx.Lock()
+	defer s.followMx.Unlock()
+
+	if !s.readOnly.Load() {
+		return ErrNotFollower
+	}
+	s.unfollow()
+	s.readOnly.Store(false)
+	return nil
+}
+
+func (s *Service) ReadOnly() bool {
+	return s.readOnly.Load()
 }
 
 func (s *Service) Ping(ctx context.Context) error {
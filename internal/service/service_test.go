@@ -3,8 +3,14 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -12,6 +18,7 @@ import (
 	"github.com/dkrasnykh/metrics-alerter/internal/logger"
 	"github.com/dkrasnykh/metrics-alerter/internal/models"
 	"github.com/dkrasnykh/metrics-alerter/internal/storage"
+	"github.com/dkrasnykh/metrics-alerter/internal/storage/mocks"
 )
 
 func TestValidate(t *testing.T) {
@@ -22,23 +29,28 @@ func TestValidate(t *testing.T) {
 	delta := int64(10)
 	value := float64(100)
 
-	err := s.Validate(models.Metrics{MType: models.CounterType, ID: `test`, Delta: &delta})
+	err := s.Validate(context.Background(), models.Metrics{MType: models.CounterType, ID: `test`, Delta: &delta})
 	require.NoError(t, err)
 
-	err = s.Validate(models.Metrics{MType: models.CounterType, ID: `test`, Value: &value})
+	err = s.Validate(context.Background(), models.Metrics{MType: models.CounterType, ID: `test`, Value: &value})
 	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrDeltaUndefined))
+	var fe *FieldError
+	require.True(t, errors.As(err, &fe))
+	assert.Equal(t, "delta", fe.Field)
 
-	err = s.Validate(models.Metrics{MType: models.CounterType, ID: ``, Delta: &delta})
+	err = s.Validate(context.Background(), models.Metrics{MType: models.CounterType, ID: ``, Delta: &delta})
 	require.Error(t, err)
 	assert.True(t, errors.Is(err, ErrIDIsEmpty))
 
-	err = s.Validate(models.Metrics{MType: models.GaugeType, ID: `test`, Value: &value})
+	err = s.Validate(context.Background(), models.Metrics{MType: models.GaugeType, ID: `test`, Value: &value})
 	require.NoError(t, err)
 
-	err = s.Validate(models.Metrics{MType: models.GaugeType, ID: `test`, Delta: &delta})
+	err = s.Validate(context.Background(), models.Metrics{MType: models.GaugeType, ID: `test`, Delta: &delta})
 	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrValueUndefined))
 
-	err = s.Validate(models.Metrics{MType: `unknown`, ID: `test`, Value: &value})
+	err = s.Validate(context.Background(), models.Metrics{MType: `unknown`, ID: `test`, Value: &value})
 	require.Error(t, err)
 	assert.True(t, errors.Is(err, ErrUnknownMetricType))
 }
@@ -55,20 +67,52 @@ func TestSave(t *testing.T) {
 	assert.Equal(t, m, saved)
 }
 
-func TestCalculateCounterValue(t *testing.T) {
+func TestSaveCounter(t *testing.T) {
 	_ = logger.InitLogger()
 	ctx := context.Background()
 	r, _ := storage.New(&config.ServerConfig{})
 	s := New(r)
 
-	value := s.calculateCounterValue(ctx, `name1`, 250)
-	assert.Equal(t, int64(250), value)
-	delta := int64(500)
-	_, err := r.Create(ctx, models.Metrics{MType: models.CounterType, ID: `name1`, Delta: &delta})
+	delta := int64(250)
+	saved, err := s.Save(ctx, models.Metrics{MType: models.CounterType, ID: `name1`, Delta: &delta})
 	require.NoError(t, err)
+	assert.Equal(t, int64(250), *saved.Delta)
 
-	value = s.calculateCounterValue(ctx, `name1`, 250)
-	assert.Equal(t, int64(750), value)
+	delta = int64(500)
+	saved, err = s.Save(ctx, models.Metrics{MType: models.CounterType, ID: `name1`, Delta: &delta})
+	require.NoError(t, err)
+	assert.Equal(t, int64(750), *saved.Delta)
+}
+
+func TestSaveCounterConcurrent(t *testing.T) {
+	_ = logger.InitLogger()
+	ctx := context.Background()
+	r, _ := storage.New(&config.ServerConfig{})
+	s := New(r)
+
+	const workers, iterations = 50, 100
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				delta := int64(1)
+				_, err := s.Save(ctx, models.Metrics{MType: models.CounterType, ID: `name1`, Delta: &delta})
+				assert.NoError(t, err)
+				err = s.Load(ctx, []models.Metrics{{MType: models.CounterType, ID: `name2`, Delta: &delta}})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := s.GetMetricValue(ctx, models.CounterType, `name1`)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%d", workers*iterations), value)
+	value, err = s.GetMetricValue(ctx, models.CounterType, `name2`)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%d", workers*iterations), value)
 }
 
 func TestGetCounterMetricValue(t *testing.T) {
@@ -105,3 +149,120 @@ func TestGetAll(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, 2, len(vals))
 }
+
+func TestCumulative(t *testing.T) {
+	_ = logger.InitLogger()
+	r, _ := storage.New(&config.ServerConfig{})
+	s := New(r)
+	epoch := time.Now().Unix()
+	a, b := WithAgent(context.Background(), "a", epoch), WithAgent(context.Background(), "b", epoch)
+	report := func(ctx context.Context, total int64) {
+		m := models.Metrics{MType: models.CounterType, ID: `PollCount`, Kind: models.CumulativeKind, Delta: &total}
+		require.NoError(t, s.Validate(context.Background(), m))
+		require.NoError(t, s.Load(ctx, []models.Metrics{m}))
+	}
+	stored := func() string {
+		v, err := s.GetMetricValue(context.Background(), models.CounterType, `PollCount`)
+		require.NoError(t, err)
+		return v
+	}
+
+	report(a, 5)
+	assert.Equal(t, "5", stored(), "the first total of a new agent is taken whole")
+	report(a, 8)
+	assert.Equal(t, "8", stored())
+	report(a, 8)
+	assert.Equal(t, "8", stored(), "a repeated total adds nothing")
+	report(b, 4)
+	assert.Equal(t, "12", stored(), "agents are tracked apart")
+	report(a, 3)
+	assert.Equal(t, "15", stored(), "a lower total is a restart")
+	report(a, 10)
+	assert.Equal(t, "22", stored())
+	report(WithAgent(context.Background(), "a", epoch+1), 12)
+	assert.Equal(t, "34", stored(), "a new epoch is a restart")
+
+	old := WithAgent(context.Background(), "c", epoch-3600)
+	report(old, 100)
+	assert.Equal(t, "34", stored(), "an agent started before the service only sets the base")
+	report(old, 103)
+	assert.Equal(t, "37", stored())
+
+	s.SetCursorTTL(time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	report(b, 6)
+	assert.Equal(t, "37", stored(), "an expired cursor sets the base again")
+	report(b, 7)
+	assert.Equal(t, "38", stored())
+
+	total := int64(-1)
+	err := s.Validate(context.Background(), models.Metrics{MType: models.CounterType, ID: `c`, Kind: models.CumulativeKind, Delta: &total})
+	assert.ErrorIs(t, err, ErrNegativeTotal)
+	value := float64(1)
+	err = s.Validate(context.Background(), models.Metrics{MType: models.GaugeType, ID: `g`, Kind: models.CumulativeKind, Value: &value})
+	assert.ErrorIs(t, err, ErrUnknownKind)
+	err = s.Validate(context.Background(), models.Metrics{MType: models.CounterType, ID: `c`, Kind: `rate`, Delta: &total})
+	assert.ErrorIs(t, err, ErrUnknownKind)
+}
+
+func TestCumulativeFailedWrite(t *testing.T) {
+	_ = logger.InitLogger()
+	ctrl := gomock.NewController(t)
+	r := mocks.NewMockStorager(ctrl)
+	s := New(r)
+	ctx := WithAgent(context.Background(), "a", time.Now().Unix())
+	total := int64(5)
+	m := models.Metrics{MType: models.CounterType, ID: `c`, Kind: models.CumulativeKind, Delta: &total}
+
+	r.EXPECT().Increment(gomock.Any(), `c`, int64(5)).Return(models.Metrics{}, errors.New("storage is down"))
+	_, err := s.Save(ctx, m)
+	require.Error(t, err)
+
+	r.EXPECT().Increment(gomock.Any(), `c`, int64(5)).Return(models.Metrics{MType: models.CounterType, ID: `c`, Delta: &total}, nil)
+	_, err = s.Save(ctx, m)
+	require.NoError(t, err, "a failed write leaves the cursor where it was")
+}
+
+func TestPolicy(t *testing.T) {
+	_ = logger.InitLogger()
+	r, _ := storage.New(&config.ServerConfig{})
+	s := New(r)
+	value := float64(1)
+	delta := int64(-1)
+	nan, inf := math.NaN(), math.Inf(1)
+
+	tests := []struct {
+		name  string
+		m     models.Metrics
+		err   error
+		field string
+	}{
+		{"control character", models.Metrics{MType: models.GaugeType, ID: "a\nb", Value: &value}, ErrNameInvalid, "id"},
+		{"long name", models.Metrics{MType: models.GaugeType, ID: strings.Repeat("a", 256), Value: &value}, ErrNameTooLong, "id"},
+		{"nan", models.Metrics{MType: models.GaugeType, ID: "g", Value: &nan}, ErrNonFinite, "value"},
+		{"inf", models.Metrics{MType: models.GaugeType, ID: "g", Value: &inf}, ErrNonFinite, "value"},
+		{"negative delta", models.Metrics{MType: models.CounterType, ID: "c", Delta: &delta}, ErrNegativeDelta, "delta"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := s.Validate(context.Background(), test.m)
+			assert.ErrorIs(t, err, test.err)
+			var fe *FieldError
+			require.True(t, errors.As(err, &fe))
+			assert.Equal(t, test.field, fe.Field)
+		})
+	}
+
+	p, err := NewPolicy(`^[a-z.]+$`, 10, []string{models.GaugeType}, []string{"internal."}, true, true)
+	require.NoError(t, err)
+	s.SetPolicy(p)
+	assert.NoError(t, s.Validate(context.Background(), models.Metrics{MType: models.GaugeType, ID: "g", Value: &nan}))
+	assert.ErrorIs(t, s.Validate(context.Background(), models.Metrics{MType: models.GaugeType, ID: "G", Value: &value}), ErrNameInvalid)
+	assert.ErrorIs(t, s.Validate(context.Background(), models.Metrics{MType: models.GaugeType, ID: "internal.g", Value: &value}), ErrNameReserved)
+	assert.ErrorIs(t, s.Validate(context.Background(), models.Metrics{MType: models.CounterType, ID: "c", Delta: &delta}), ErrTypeNotAllowed)
+
+	_, err = NewPolicy(`(`, 0, nil, nil, false, false)
+	assert.Error(t, err)
+	_, err = NewPolicy(``, 0, []string{"histogram"}, nil, false, false)
+	assert.ErrorIs(t, err, ErrUnknownMetricType)
+}
@@ -0,0 +1,104 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/tenant"
+)
+
+func (s *Storage) loadBatches(ctx context.Context, metrics []models.Metrics) error {
+	counters, gauges := merge(metrics)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(counters); start += s.batchSize {
+		err = execBatch(ctx, tx, counters[start:min(start+s.batchSize, len(counters))], incrementBatch)
+		if err != nil {
+			return rollback(tx, err)
+		}
+	}
+	for start := 0; start < len(gauges); start += s.batchSize {
+		err = execBatch(ctx, tx, gauges[start:min(start+s.batchSize, len(gauges))], insertValueBatch)
+		if err != nil {
+			return rollback(tx, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// merge splits the metrics by type with one entry per name, summing counter
+// deltas and keeping the last gauge value, as writing them one by one would;
+// an upsert cannot touch the same row twice in one statement.
+func merge(metrics []models.Metrics) ([]models.Metrics, []models.Metrics) {
+	counters := make([]models.Metrics, 0, len(metrics))
+	gauges := make([]models.Metrics, 0, len(metrics))
+	counterAt := make(map[string]int)
+	gaugeAt := make(map[string]int)
+	for _, m := range metrics {
+		switch m.MType {
+		case models.CounterType:
+			i, ok := counterAt[m.ID]
+			if !ok {
+				counterAt[m.ID] = len(counters)
+				counters = append(counters, m)
+				continue
+			}
+			delta := *counters[i].Delta + *m.Delta
+			counters[i].Delta = &delta
+		case models.GaugeType:
+			i, ok := gaugeAt[m.ID]
+			if !ok {
+				gaugeAt[m.ID] = len(gauges)
+				gauges = append(gauges, m)
+				continue
+			}
+			gauges[i].Value = m.Value
+		}
+	}
+	return counters, gauges
+}
+
+func execBatch(ctx context.Context, tx *sql.Tx, metrics []models.Metrics, query func(rows int) string) error {
+	id := tenant.ID(ctx)
+	args := make([]any, 0, 4*len(metrics))
+	for _, m := range metrics {
+		switch m.MType {
+		case models.CounterType:
+			args = append(args, m.ID, m.MType, *m.Delta, id)
+		case models.GaugeType:
+			args = append(args, m.ID, m.MType, *m.Value, id)
+		}
+	}
+	_, err := tx.ExecContext(ctx, query(len(metrics)), args...)
+	return err
+}
+
+func incrementBatch(rows int) string {
+	return `WITH l AS (INSERT INTO metrics_latest (name, type, delta, tenant) VALUES ` + placeholders(rows) + `
+					ON CONFLICT (tenant, name, type) DO UPDATE SET delta = metrics_latest.delta + EXCLUDED.delta, time = EXCLUDED.time
+					RETURNING tenant, name, type, delta, time)
+				INSERT INTO metrics (tenant, name, type, delta, time) SELECT tenant, name, type, delta, time FROM l;`
+}
+
+func insertValueBatch(rows int) string {
+	return `WITH h AS (INSERT INTO metrics (name, type, value, tenant) VALUES ` + placeholders(rows) + `
+					RETURNING tenant, name, type, value, time)
+				INSERT INTO metrics_latest (tenant, name, type, value, time) SELECT tenant, name, type, value, time FROM h
+				ON CONFLICT (tenant, name, type) DO UPDATE SET value = EXCLUDED.value, delta = NULL, time = EXCLUDED.time;`
+}
+
+func placeholders(rows int) string {
+	var b strings.Builder
+	for i := 0; i < rows; i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "($%d, $%d, $%d, $%d)", 4*i+1, 4*i+2, 4*i+3, 4*i+4)
+	}
+	return b.String()
+}
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+)
+
+func TestLoadBatches(t *testing.T) {
+	_ = logger.InitLogger()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	sqlxDB := sqlx.NewDb(mockDB, "sqlmock")
+
+	r := Storage{db: sqlxDB, batchSize: 2}
+	ctx := context.Background()
+
+	d1, d2 := int64(1), int64(2)
+	v1, v2, v3 := float64(1), float64(2), float64(3)
+	metrics := []models.Metrics{
+		{MType: models.CounterType, ID: "c1", Delta: &d1},
+		{MType: models.GaugeType, ID: "g1", Value: &v1},
+		{MType: models.CounterType, ID: "c2", Delta: &d2},
+		{MType: models.GaugeType, ID: "g2", Value: &v2},
+		{MType: models.GaugeType, ID: "g3", Value: &v3},
+	}
+
+	tests := []struct {
+		name    string
+		input   []models.Metrics
+		mock    func()
+		wantErr bool
+	}{
+		{
+			name:  "ok",
+			input: metrics,
+			mock: func() {
+				mock.ExpectBegin()
+				mock.ExpectExec(`INSERT INTO metrics_latest \(name, type, delta, tenant\) VALUES \(\$1, \$2, \$3, \$4\), \(\$5, \$6, \$7, \$8\)`).
+					WithArgs("c1", models.CounterType, d1, "", "c2", models.CounterType, d2, "").
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec(`INSERT INTO metrics \(name, type, value, tenant\) VALUES \(\$1, \$2, \$3, \$4\), \(\$5, \$6, \$7, \$8\)\s+RETURNING`).
+					WithArgs("g1", models.GaugeType, v1, "", "g2", models.GaugeType, v2, "").
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec(`INSERT INTO metrics \(name, type, value, tenant\) VALUES \(\$1, \$2, \$3, \$4\)\s+RETURNING`).
+					WithArgs("g3", models.GaugeType, v3, "").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "duplicate names",
+			input: []models.Metrics{
+				{MType: models.CounterType, ID: "c1", Delta: &d1},
+				{MType: models.GaugeType, ID: "g1", Value: &v1},
+				{MType: models.CounterType, ID: "c1", Delta: &d2},
+				{MType: models.GaugeType, ID: "g1", Value: &v2},
+			},
+			mock: func() {
+				mock.ExpectBegin()
+				mock.ExpectExec(`INSERT INTO metrics_latest \(name, type, delta, tenant\) VALUES \(\$1, \$2, \$3, \$4\)\s`).
+					WithArgs("c1", models.CounterType, d1+d2, "").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO metrics \(name, type, value, tenant\) VALUES \(\$1, \$2, \$3, \$4\)\s+RETURNING`).
+					WithArgs("g1", models.GaugeType, v2, "").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:  "insertion error",
+			input: metrics,
+			mock: func() {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO metrics_latest").WillReturnError(ErrTest)
+				mock.ExpectRollback()
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mock()
+
+			err := r.Load(ctx, tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+	_ = mockDB.Close()
+}
+
+// BenchmarkLoad compares writing row by row with writing in batches. It runs
+// against TEST_DATABASE_DSN when set and otherwise against a stub database,
+// which measures only the statements sent.
+func BenchmarkLoad(b *testing.B) {
+	_ = logger.InitLogger()
+	ctx := context.Background()
+
+	metrics := make([]models.Metrics, 0, 32)
+	for i := 0; i < 31; i++ {
+		v := float64(i)
+		metrics = append(metrics, models.Metrics{MType: models.GaugeType, ID: fmt.Sprintf("BenchGauge%d", i), Value: &v})
+	}
+	delta := int64(1)
+	metrics = append(metrics, models.Metrics{MType: models.CounterType, ID: "BenchCounter", Delta: &delta})
+
+	var r *Storage
+	expect := func(statements int) {}
+	if dsn := os.Getenv("TEST_DATABASE_DSN"); dsn != "" {
+		var err error
+		r, err = New(dsn)
+		require.NoError(b, err)
+	} else {
+		mockDB, mock, err := sqlmock.New()
+		require.NoError(b, err)
+		defer mockDB.Close()
+		r = &Storage{db: sqlx.NewDb(mockDB, "sqlmock")}
+		expect = func(statements int) {
+			mock.ExpectBegin()
+			for i := 0; i < statements; i++ {
+				mock.ExpectExec("INSERT").WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			mock.ExpectCommit()
+		}
+	}
+
+	for _, size := range []int{1, 100} {
+		statements := len(metrics)
+		if size > 1 {
+			statements = 2
+		}
+		b.Run(fmt.Sprintf("batch size %d", size), func(b *testing.B) {
+			r.SetBatchSize(size)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				expect(statements)
+				b.StartTimer()
+				err := r.Load(ctx, metrics)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
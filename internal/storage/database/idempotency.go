@@ -0,0 +1,53 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/idempotency"
+)
+
+// Idempotency keeps request results in the database, so that a retry is
+// recognized by every server sharing it.
+type Idempotency struct {
+	db  *sqlx.DB
+	ttl time.Duration
+}
+
+// NewIdempotency keeps results in db, whose schema is expected to be migrated.
+func NewIdempotency(db *sqlx.DB, ttl time.Duration) *Idempotency {
+	return &Idempotency{db: db, ttl: ttl}
+}
+
+func (s *Idempotency) Find(ctx context.Context, key string) (idempotency.Result, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT status, content_type, body, created FROM idempotency_keys WHERE key=$1 AND created >= $2;`,
+		key, time.Now().UTC().Add(-s.ttl))
+	var r idempotency.Result
+	err := row.Scan(&r.Status, &r.ContentType, &r.Body, &r.Created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return idempotency.Result{}, idempotency.ErrNotFound
+	}
+	if err != nil {
+		return idempotency.Result{}, err
+	}
+	return r, nil
+}
+
+// Save also drops the results that have expired.
+func (s *Idempotency) Save(ctx context.Context, key string, r idempotency.Result) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE created < $1;`, time.Now().UTC().Add(-s.ttl))
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO idempotency_keys (key, status, content_type, body, created) VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (key) DO UPDATE SET status = EXCLUDED.status, content_type = EXCLUDED.content_type,
+				body = EXCLUDED.body, created = EXCLUDED.created;`,
+		key, r.Status, r.ContentType, r.Body, r.Created.UTC())
+	return err
+}
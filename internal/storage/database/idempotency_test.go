@@ -0,0 +1,45 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/idempotency"
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+)
+
+func TestIdempotency(t *testing.T) {
+	_ = logger.InitLogger()
+	mockDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	s := Idempotency{db: sqlx.NewDb(mockDB, "sqlmock"), ttl: time.Hour}
+	ctx := context.Background()
+	created := time.Now().UTC()
+	r := idempotency.Result{Status: 200, ContentType: "application/json", Body: []byte(`{}`), Created: created}
+
+	mock.ExpectExec("DELETE FROM idempotency_keys WHERE created < \\$1;").WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO idempotency_keys").WithArgs("k1", 200, "application/json", []byte(`{}`), created).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	require.NoError(t, s.Save(ctx, "k1", r))
+
+	mock.ExpectQuery("SELECT (.+) FROM idempotency_keys WHERE key=\\$1").WithArgs("k1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "content_type", "body", "created"}).
+			AddRow(200, "application/json", []byte(`{}`), created))
+	found, err := s.Find(ctx, "k1")
+	require.NoError(t, err)
+	assert.Equal(t, r, found)
+
+	mock.ExpectQuery("SELECT (.+) FROM idempotency_keys WHERE key=\\$1").WithArgs("k2", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "content_type", "body", "created"}))
+	_, err = s.Find(ctx, "k2")
+	assert.ErrorIs(t, err, idempotency.ErrNotFound)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,171 @@
+package database
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+)
+
+// migrationLock is the pg_advisory_xact_lock key held while migrations run,
+// so that servers starting concurrently apply them one at a time.
+const migrationLock int64 = 7216013
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+func Migrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	ms := make([]Migration, 0, len(entries))
+	for _, e := range entries {
+		version, name, ok := strings.Cut(strings.TrimSuffix(e.Name(), ".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration file %s must be named <version>_<name>.sql", e.Name())
+		}
+		v, err := strconv.Atoi(version)
+		if err != nil {
+			return nil, fmt.Errorf("migration file %s has invalid version: %w", e.Name(), err)
+		}
+		buf, err := migrationFiles.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, Migration{Version: v, Name: name, SQL: string(buf)})
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	for i := 1; i < len(ms); i++ {
+		if ms[i].Version == ms[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", ms[i].Version)
+		}
+	}
+	return ms, nil
+}
+
+func Migrate(ctx context.Context, db *sqlx.DB) error {
+	ms, err := Migrations()
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1);`, migrationLock)
+	if err != nil {
+		return rollback(tx, err)
+	}
+	_, err = tx.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS schema_migrations
+				(
+				    version       integer      PRIMARY KEY,
+				    name          varchar(255) not null,
+				    applied_at    timestamp without time zone NOT NULL DEFAULT (current_timestamp AT TIME ZONE 'UTC')
+				);`)
+	if err != nil {
+		return rollback(tx, err)
+	}
+	applied := map[int]bool{}
+	rows, err := tx.QueryContext(ctx, `SELECT version FROM schema_migrations;`)
+	if err != nil {
+		return rollback(tx, err)
+	}
+	for rows.Next() {
+		var v int
+		err = rows.Scan(&v)
+		if err != nil {
+			logger.LogErrorIfNotNil(rows.Close())
+			return rollback(tx, err)
+		}
+		applied[v] = true
+	}
+	logger.LogErrorIfNotNil(rows.Close())
+	for _, m := range ms {
+		if applied[m.Version] {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, m.SQL)
+		if err != nil {
+			return rollback(tx, fmt.Errorf("applying migration %04d_%s: %w", m.Version, m.Name, err))
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2);`, m.Version, m.Name)
+		if err != nil {
+			return rollback(tx, err)
+		}
+		logger.Info(fmt.Sprintf("applied migration %04d_%s", m.Version, m.Name))
+	}
+	return tx.Commit()
+}
+
+func Pending(ctx context.Context, db *sqlx.DB) ([]Migration, error) {
+	ms, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	var exists bool
+	err = db.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL;`).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return ms, nil
+	}
+	applied := map[int]bool{}
+	versions := []int{}
+	err = db.SelectContext(ctx, &versions, `SELECT version FROM schema_migrations;`)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		applied[v] = true
+	}
+	pending := make([]Migration, 0)
+	for _, m := range ms {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+func PrintPending(ctx context.Context, url string, w io.Writer) error {
+	db, err := sqlx.Open("pgx", url)
+	if err != nil {
+		return err
+	}
+	defer func(db *sqlx.DB) {
+		err := db.Close()
+		logger.LogErrorIfNotNil(err)
+	}(db)
+	ms, err := Pending(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(ms) == 0 {
+		_, err = fmt.Fprintln(w, "no pending migrations")
+		return err
+	}
+	for _, m := range ms {
+		_, err = fmt.Fprintf(w, "%04d_%s\n", m.Version, m.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
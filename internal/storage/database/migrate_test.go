@@ -0,0 +1,133 @@
+package database
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+)
+
+func TestMigrations(t *testing.T) {
+	ms, err := Migrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, ms)
+	for i, m := range ms {
+		assert.Equal(t, i+1, m.Version)
+		assert.NotEmpty(t, m.Name)
+		assert.NotEmpty(t, m.SQL)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	_ = logger.InitLogger()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	sqlxDB := sqlx.NewDb(mockDB, "sqlmock")
+	ctx := context.Background()
+	ms, err := Migrations()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		mock    func()
+		wantErr bool
+	}{
+		{
+			name: "ok apply pending",
+			mock: func() {
+				mock.ExpectBegin()
+				mock.ExpectExec("SELECT pg_advisory_xact_lock").WithArgs(migrationLock).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT version FROM schema_migrations").
+					WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1))
+				for _, m := range ms[1:] {
+					mock.ExpectExec(regexp.QuoteMeta(m.SQL)).WillReturnResult(sqlmock.NewResult(0, 0))
+					mock.ExpectExec("INSERT INTO schema_migrations").WithArgs(m.Version, m.Name).
+						WillReturnResult(sqlmock.NewResult(1, 1))
+				}
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "ok nothing pending",
+			mock: func() {
+				rows := sqlmock.NewRows([]string{"version"})
+				for _, m := range ms {
+					rows.AddRow(m.Version)
+				}
+				mock.ExpectBegin()
+				mock.ExpectExec("SELECT pg_advisory_xact_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT version FROM schema_migrations").WillReturnRows(rows)
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "migration error",
+			mock: func() {
+				mock.ExpectBegin()
+				mock.ExpectExec("SELECT pg_advisory_xact_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT version FROM schema_migrations").
+					WillReturnRows(sqlmock.NewRows([]string{"version"}))
+				mock.ExpectExec("CREATE TABLE IF NOT EXISTS metrics").WillReturnError(ErrTest)
+				mock.ExpectRollback()
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mock()
+
+			err := Migrate(ctx, sqlxDB)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+	_ = mockDB.Close()
+}
+
+func TestPending(t *testing.T) {
+	_ = logger.InitLogger()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	sqlxDB := sqlx.NewDb(mockDB, "sqlmock")
+	ctx := context.Background()
+	ms, err := Migrations()
+	require.NoError(t, err)
+
+	mock.ExpectQuery("SELECT to_regclass").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	pending, err := Pending(ctx, sqlxDB)
+	require.NoError(t, err)
+	assert.Equal(t, ms, pending)
+
+	mock.ExpectQuery("SELECT to_regclass").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("SELECT version FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1))
+	pending, err = Pending(ctx, sqlxDB)
+	require.NoError(t, err)
+	assert.Equal(t, ms[1:], pending)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	_ = mockDB.Close()
+}
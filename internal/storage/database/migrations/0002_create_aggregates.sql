@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS metrics_hourly
+(
+    name          varchar(255) not null,
+    type          varchar(255) not null,
+    bucket        timestamp without time zone not null,
+    delta         bigint,
+    value         double precision,
+    min_value     double precision,
+    max_value     double precision,
+    samples       bigint       not null,
+    PRIMARY KEY (name, type, bucket)
+);
+CREATE TABLE IF NOT EXISTS metrics_daily
+(
+    name          varchar(255) not null,
+    type          varchar(255) not null,
+    bucket        timestamp without time zone not null,
+    delta         bigint,
+    value         double precision,
+    min_value     double precision,
+    max_value     double precision,
+    samples       bigint       not null,
+    PRIMARY KEY (name, type, bucket)
+);
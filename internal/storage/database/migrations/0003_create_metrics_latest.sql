@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS metrics_latest
+(
+    name          varchar(255) not null,
+    type          varchar(255) not null,
+    delta         bigint,
+    value         double precision,
+    time          timestamp without time zone NOT NULL DEFAULT (current_timestamp AT TIME ZONE 'UTC'),
+    PRIMARY KEY (name, type)
+);
+INSERT INTO metrics_latest (name, type, delta, value, time)
+SELECT DISTINCT ON (name, type) name, type, delta, value, time
+FROM metrics
+ORDER BY name, type, time DESC, id DESC
+ON CONFLICT (name, type) DO NOTHING;
@@ -0,0 +1,14 @@
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS tenant varchar(255) not null DEFAULT '';
+CREATE INDEX IF NOT EXISTS tenant_idx ON metrics (tenant);
+
+ALTER TABLE metrics_latest ADD COLUMN IF NOT EXISTS tenant varchar(255) not null DEFAULT '';
+ALTER TABLE metrics_latest DROP CONSTRAINT IF EXISTS metrics_latest_pkey;
+ALTER TABLE metrics_latest ADD PRIMARY KEY (tenant, name, type);
+
+ALTER TABLE metrics_hourly ADD COLUMN IF NOT EXISTS tenant varchar(255) not null DEFAULT '';
+ALTER TABLE metrics_hourly DROP CONSTRAINT IF EXISTS metrics_hourly_pkey;
+ALTER TABLE metrics_hourly ADD PRIMARY KEY (tenant, name, type, bucket);
+
+ALTER TABLE metrics_daily ADD COLUMN IF NOT EXISTS tenant varchar(255) not null DEFAULT '';
+ALTER TABLE metrics_daily DROP CONSTRAINT IF EXISTS metrics_daily_pkey;
+ALTER TABLE metrics_daily ADD PRIMARY KEY (tenant, name, type, bucket);
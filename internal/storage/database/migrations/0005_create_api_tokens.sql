@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS api_tokens
+(
+    id            varchar(255) PRIMARY KEY,
+    hash          varchar(64) not null UNIQUE,
+    scopes        varchar(255) not null,
+    tenant        varchar(255) not null DEFAULT '',
+    created       timestamp without time zone NOT NULL DEFAULT (current_timestamp AT TIME ZONE 'UTC')
+);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+    key           text PRIMARY KEY,
+    status        integer not null,
+    content_type  varchar(255) not null DEFAULT '',
+    body          bytea not null,
+    created       timestamp without time zone NOT NULL DEFAULT (current_timestamp AT TIME ZONE 'UTC')
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_idx ON idempotency_keys (created);
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/tenant"
+)
+
+type Retention struct {
+	Raw    time.Duration
+	Hourly time.Duration
+}
+
+func (s *Storage) RunCompaction(ctx context.Context, r Retention, interval time.Duration) {
+	if interval <= 0 || r.Raw <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			err := s.Compact(ctx, r, t)
+			if err != nil {
+				logger.Error(fmt.Sprintf("metrics compaction: %s", err.Error()))
+			}
+		}
+	}
+}
+
+func (s *Storage) Compact(ctx context.Context, r Retention, now time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	rawBefore := now.UTC().Add(-r.Raw).Truncate(time.Hour)
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO metrics_hourly (tenant, name, type, bucket, delta, value, min_value, max_value, samples)
+				SELECT tenant, name, type, date_trunc('hour', time), (array_agg(delta ORDER BY time DESC))[1],
+					AVG(value), MIN(value), MAX(value), COUNT(*)
+				FROM metrics WHERE time < $1
+				GROUP BY tenant, name, type, date_trunc('hour', time)
+				ON CONFLICT (tenant, name, type, bucket) DO UPDATE SET
+					delta = EXCLUDED.delta,
+					value = (metrics_hourly.value * metrics_hourly.samples + EXCLUDED.value * EXCLUDED.samples) /
+						(metrics_hourly.samples + EXCLUDED.samples),
+					min_value = LEAST(metrics_hourly.min_value, EXCLUDED.min_value),
+					max_value = GREATEST(metrics_hourly.max_value, EXCLUDED.max_value),
+					samples = metrics_hourly.samples + EXCLUDED.samples;`, rawBefore)
+	if err != nil {
+		return rollback(tx, err)
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM metrics WHERE time < $1;`, rawBefore)
+	if err != nil {
+		return rollback(tx, err)
+	}
+	if r.Hourly > 0 {
+		hourlyBefore := now.UTC().Add(-r.Hourly).Truncate(24 * time.Hour)
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO metrics_daily (tenant, name, type, bucket, delta, value, min_value, max_value, samples)
+					SELECT tenant, name, type, date_trunc('day', bucket), (array_agg(delta ORDER BY bucket DESC))[1],
+						SUM(value * samples) / SUM(samples), MIN(min_value), MAX(max_value), SUM(samples)
+					FROM metrics_hourly WHERE bucket < $1
+					GROUP BY tenant, name, type, date_trunc('day', bucket)
+					ON CONFLICT (tenant, name, type, bucket) DO UPDATE SET
+						delta = EXCLUDED.delta,
+						value = (metrics_daily.value * metrics_daily.samples + EXCLUDED.value * EXCLUDED.samples) /
+							(metrics_daily.samples + EXCLUDED.samples),
+						min_value = LEAST(metrics_daily.min_value, EXCLUDED.min_value),
+						max_value = GREATEST(metrics_daily.max_value, EXCLUDED.max_value),
+						samples = metrics_daily.samples + EXCLUDED.samples;`, hourlyBefore)
+		if err != nil {
+			return rollback(tx, err)
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM metrics_hourly WHERE bucket < $1;`, hourlyBefore)
+		if err != nil {
+			return rollback(tx, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Storage) History(ctx context.Context, mType, name string, from, to time.Time) ([]models.Point, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT time, delta, value FROM metrics
+					WHERE type=$1 AND name=$2 AND time >= $3 AND time < $4 AND tenant=$5
+				UNION ALL
+				SELECT bucket, delta, value FROM metrics_hourly
+					WHERE type=$1 AND name=$2 AND bucket >= $3 AND bucket < $4 AND tenant=$5
+				UNION ALL
+				SELECT bucket, delta, value FROM metrics_daily
+					WHERE type=$1 AND name=$2 AND bucket >= $3 AND bucket < $4 AND tenant=$5
+				ORDER BY 1;`, mType, name, from.UTC(), to.UTC(), tenant.ID(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		logger.LogErrorIfNotNil(err)
+	}(rows)
+	points := make([]models.Point, 0)
+	for rows.Next() {
+		var p models.Point
+		var delta sql.NullInt64
+		var value sql.NullFloat64
+		err = rows.Scan(&p.Time, &delta, &value)
+		if err != nil {
+			return nil, err
+		}
+		if delta.Valid {
+			p.Delta = &delta.Int64
+		}
+		if value.Valid {
+			p.Value = &value.Float64
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+func rollback(tx *sql.Tx, err error) error {
+	logger.LogErrorIfNotNil(tx.Rollback())
+	return err
+}
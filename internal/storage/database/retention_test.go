@@ -0,0 +1,124 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+)
+
+func TestCompact(t *testing.T) {
+	_ = logger.InitLogger()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	sqlxDB := sqlx.NewDb(mockDB, "sqlmock")
+
+	r := Storage{db: sqlxDB}
+	ctx := context.Background()
+	now := time.Date(2024, 1, 10, 15, 30, 0, 0, time.UTC)
+	rawBefore := time.Date(2024, 1, 3, 15, 0, 0, 0, time.UTC)
+	hourlyBefore := time.Date(2023, 10, 12, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		retention Retention
+		mock      func()
+		wantErr   bool
+	}{
+		{
+			name:      "ok raw and hourly",
+			retention: Retention{Raw: 7 * 24 * time.Hour, Hourly: 90 * 24 * time.Hour},
+			mock: func() {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO metrics_hourly (.+) FROM metrics").WithArgs(rawBefore).
+					WillReturnResult(sqlmock.NewResult(0, 10))
+				mock.ExpectExec("DELETE FROM metrics WHERE").WithArgs(rawBefore).
+					WillReturnResult(sqlmock.NewResult(0, 100))
+				mock.ExpectExec("INSERT INTO metrics_daily (.+) FROM metrics_hourly").WithArgs(hourlyBefore).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("DELETE FROM metrics_hourly").WithArgs(hourlyBefore).
+					WillReturnResult(sqlmock.NewResult(0, 24))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:      "ok raw only",
+			retention: Retention{Raw: 7 * 24 * time.Hour},
+			mock: func() {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO metrics_hourly").WithArgs(rawBefore).
+					WillReturnResult(sqlmock.NewResult(0, 10))
+				mock.ExpectExec("DELETE FROM metrics WHERE").WithArgs(rawBefore).
+					WillReturnResult(sqlmock.NewResult(0, 100))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:      "aggregation error",
+			retention: Retention{Raw: 7 * 24 * time.Hour},
+			mock: func() {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO metrics_hourly").WithArgs(rawBefore).WillReturnError(ErrTest)
+				mock.ExpectRollback()
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mock()
+
+			err := r.Compact(ctx, tt.retention, now)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+	_ = mockDB.Close()
+}
+
+func TestHistory(t *testing.T) {
+	_ = logger.InitLogger()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	sqlxDB := sqlx.NewDb(mockDB, "sqlmock")
+
+	r := Storage{db: sqlxDB}
+	ctx := context.Background()
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	daily := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	raw := time.Date(2024, 1, 9, 12, 0, 0, 0, time.UTC)
+	v1, v2 := float64(1.5), float64(2)
+
+	rows := sqlmock.NewRows([]string{"time", "delta", "value"}).
+		AddRow(daily, nil, v1).
+		AddRow(raw, nil, v2)
+	mock.ExpectQuery("SELECT (.+) FROM metrics (.+) UNION ALL (.+) FROM metrics_hourly (.+) UNION ALL (.+) FROM metrics_daily").
+		WithArgs(models.GaugeType, "name1", from, to, "").WillReturnRows(rows)
+
+	got, err := r.History(ctx, models.GaugeType, "name1", from, to)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.Point{{Time: daily, Value: &v1}, {Time: raw, Value: &v2}}, got)
+
+	mock.ExpectQuery("SELECT (.+) FROM metrics").WillReturnError(ErrTest)
+	_, err = r.History(ctx, models.GaugeType, "name1", from, to)
+	assert.Error(t, err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	_ = mockDB.Close()
+}
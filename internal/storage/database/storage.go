@@ -3,6 +3,7 @@ package database
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
@@ -10,56 +11,69 @@ import (
 
 	"github.com/dkrasnykh/metrics-alerter/internal/logger"
 	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/repository"
+	"github.com/dkrasnykh/metrics-alerter/internal/tenant"
+)
+
+const (
+	insertDelta = `WITH h AS (INSERT INTO metrics (name, type, delta, tenant) VALUES ($1, $2, $3, $4)
+					RETURNING tenant, name, type, delta, time)
+				INSERT INTO metrics_latest (tenant, name, type, delta, time) SELECT tenant, name, type, delta, time FROM h
+				ON CONFLICT (tenant, name, type) DO UPDATE SET delta = EXCLUDED.delta, value = NULL, time = EXCLUDED.time;`
+	insertValue = `WITH h AS (INSERT INTO metrics (name, type, value, tenant) VALUES ($1, $2, $3, $4)
+					RETURNING tenant, name, type, value, time)
+				INSERT INTO metrics_latest (tenant, name, type, value, time) SELECT tenant, name, type, value, time FROM h
+				ON CONFLICT (tenant, name, type) DO UPDATE SET value = EXCLUDED.value, delta = NULL, time = EXCLUDED.time;`
+	incrementDelta = `WITH l AS (INSERT INTO metrics_latest (name, type, delta, tenant) VALUES ($1, $2, $3, $4)
+					ON CONFLICT (tenant, name, type) DO UPDATE SET delta = metrics_latest.delta + EXCLUDED.delta, time = EXCLUDED.time
+					RETURNING tenant, name, type, delta, time)
+				INSERT INTO metrics (tenant, name, type, delta, time) SELECT tenant, name, type, delta, time FROM l RETURNING delta;`
 )
 
 type Storage struct {
-	db *sqlx.DB
+	db        *sqlx.DB
+	ttl       map[string]time.Duration
+	batchSize int
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
 }
 
 func New(url string) (*Storage, error) {
-	db, err := sqlx.Open("pgx", url)
+	db, err := Open(url)
 	if err != nil {
 		return nil, err
 	}
-	return &Storage{db: db}, InitDB(db)
+	return &Storage{db: db, ttl: map[string]time.Duration{}}, nil
 }
 
-func InitDB(db *sqlx.DB) error {
-	tx, err := db.Begin()
+// Open connects to the database and brings its schema up to date.
+func Open(url string) (*sqlx.DB, error) {
+	db, err := sqlx.Open("pgx", url)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
-	_, err = tx.ExecContext(ctx,
-		`CREATE TABLE IF NOT EXISTS metrics
-				(
- 				    id            serial       not null unique,
-				    name          varchar(255) not null,
- 					type          varchar(255) not null,
-				    delta         bigint,
-					value         double precision,
-					time          timestamp without time zone NOT NULL DEFAULT (current_timestamp AT TIME ZONE 'UTC')
-				);
-				CREATE INDEX IF NOT EXISTS name_idx ON metrics (name);
-				CREATE INDEX IF NOT EXISTS type_idx ON metrics (type);`,
-	)
+	err = Migrate(context.Background(), db)
 	if err != nil {
-		err = tx.Rollback()
-		logger.LogErrorIfNotNil(err)
+		logger.LogErrorIfNotNil(db.Close())
+		return nil, err
 	}
-	return tx.Commit()
+	return db, nil
+}
+
+// DB returns the connection pool, for the stores that share the database.
+func (s *Storage) DB() *sqlx.DB {
+	return s.db
 }
 
 func (s *Storage) Create(ctx context.Context, metric models.Metrics) (models.Metrics, error) {
 	var err error
 	switch metric.MType {
 	case models.GaugeType:
-		_, err = s.db.ExecContext(ctx, `INSERT INTO metrics (name, type, value) VALUES ($1, $2, $3);`,
-			metric.ID, metric.MType, *metric.Value)
+		_, err = s.db.ExecContext(ctx, insertValue, metric.ID, metric.MType, *metric.Value, tenant.ID(ctx))
 	case models.CounterType:
-		_, err = s.db.ExecContext(ctx, `INSERT INTO metrics (name, type, delta) VALUES ($1, $2, $3);`,
-			metric.ID, metric.MType, *metric.Delta)
+		_, err = s.db.ExecContext(ctx, insertDelta, metric.ID, metric.MType, *metric.Delta, tenant.ID(ctx))
 	}
 	if err != nil {
 		return models.Metrics{}, err
@@ -67,29 +81,40 @@ func (s *Storage) Create(ctx context.Context, metric models.Metrics) (models.Met
 	return metric, nil
 }
 
+func (s *Storage) Increment(ctx context.Context, name string, delta int64) (models.Metrics, error) {
+	var total int64
+	err := s.db.QueryRowContext(ctx, incrementDelta, name, models.CounterType, delta, tenant.ID(ctx)).Scan(&total)
+	if err != nil {
+		return models.Metrics{}, err
+	}
+	return models.Metrics{MType: models.CounterType, ID: name, Delta: &total}, nil
+}
+
 func (s *Storage) Get(ctx context.Context, mType, name string) (models.Metrics, error) {
-	row := s.db.QueryRowContext(ctx, `select delta, value from metrics where name=$1 and type=$2 ORDER BY time DESC LIMIT 1;`, name, mType)
+	row := s.db.QueryRowContext(ctx, `select delta, value, time from metrics_latest where name=$1 and type=$2 and tenant=$3;`,
+		name, mType, tenant.ID(ctx))
 	if row.Err() != nil {
 		return models.Metrics{}, row.Err()
 	}
 	var delta sql.NullInt64
 	var value sql.NullFloat64
+	var updated time.Time
 
-	err := row.Scan(&delta, &value)
-
+	err := row.Scan(&delta, &value, &updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Metrics{}, repository.ErrNotFound
+	}
 	if err != nil {
 		return models.Metrics{}, err
 	}
 
-	return metric(models.Metrics{MType: mType, ID: name}, delta, value), nil
+	return s.stale(metric(models.Metrics{MType: mType, ID: name}, delta, value), updated), nil
 }
 
 func (s *Storage) GetAll(ctx context.Context) ([]models.Metrics, error) {
 	metrics := make([]models.Metrics, 0)
 	rows, err := s.db.QueryContext(ctx,
-		`SELECT t1.name, t1.type, m.delta, m.value FROM 
-				(select name, type, MAX(time) as time from metrics group by name, type) AS t1 
-				LEFT JOIN metrics AS m ON t1.name = m.name AND t1.type=m.type AND t1.time = m.time;`)
+		`SELECT name, type, delta, value, time FROM metrics_latest WHERE tenant=$1;`, tenant.ID(ctx))
 
 	if err != nil {
 		return nil, err
@@ -102,9 +127,10 @@ func (s *Storage) GetAll(ctx context.Context) ([]models.Metrics, error) {
 		var m models.Metrics
 		var delta sql.NullInt64
 		var value sql.NullFloat64
-		err = rows.Scan(&m.ID, &m.MType, &delta, &value)
+		var updated time.Time
+		err = rows.Scan(&m.ID, &m.MType, &delta, &value, &updated)
 		logger.LogErrorIfNotNil(err)
-		metrics = append(metrics, metric(m, delta, value))
+		metrics = append(metrics, s.stale(metric(m, delta, value), updated))
 	}
 	err = rows.Close()
 	logger.LogErrorIfNotNil(err)
@@ -112,29 +138,54 @@ func (s *Storage) GetAll(ctx context.Context) ([]models.Metrics, error) {
 }
 
 func (s *Storage) Load(ctx context.Context, metrics []models.Metrics) error {
-	tx, err := s.db.Begin()
+	if s.batchSize <= 1 {
+		return s.loadRows(ctx, metrics)
+	}
+	return s.loadBatches(ctx, metrics)
+}
+
+func (s *Storage) loadRows(ctx context.Context, metrics []models.Metrics) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil
+		return err
 	}
 	for _, m := range metrics {
 		switch m.MType {
 		case models.CounterType:
-			_, err = tx.ExecContext(ctx,
-				"INSERT INTO metrics (name, type, delta) VALUES($1,$2,$3)",
-				m.ID, m.MType, *m.Delta)
+			_, err = tx.ExecContext(ctx, incrementDelta, m.ID, m.MType, *m.Delta, tenant.ID(ctx))
 		case models.GaugeType:
-			_, err = tx.ExecContext(ctx,
-				"INSERT INTO metrics (name, type, value) VALUES($1,$2,$3)",
-				m.ID, m.MType, *m.Value)
+			_, err = tx.ExecContext(ctx, insertValue, m.ID, m.MType, *m.Value, tenant.ID(ctx))
 		}
 		if err != nil {
-			err = tx.Rollback()
-			return err
+			return rollback(tx, err)
 		}
 	}
 	return tx.Commit()
 }
 
+func (s *Storage) Purge(ctx context.Context, mType string, before time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		`WITH expired AS (DELETE FROM metrics_latest WHERE type=$1 AND time < $2 RETURNING tenant, name)
+				DELETE FROM metrics WHERE type=$1 AND (tenant, name) IN (SELECT tenant, name FROM expired);`,
+		mType, before.UTC())
+	return err
+}
+
+func (s *Storage) SetBatchSize(size int) {
+	s.batchSize = size
+}
+
+func (s *Storage) SetTTL(ttl map[string]time.Duration) {
+	s.ttl = ttl
+}
+
+func (s *Storage) stale(m models.Metrics, updated time.Time) models.Metrics {
+	if ttl := s.ttl[m.MType]; ttl > 0 {
+		m.Stale = time.Now().UTC().Sub(updated) > ttl
+	}
+	return m
+}
+
 func (s *Storage) Ping(ctx context.Context) error {
 	return s.db.PingContext(ctx)
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/jmoiron/sqlx"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/dkrasnykh/metrics-alerter/internal/logger"
 	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/repository"
 )
 
 var ErrTest = errors.New("database access error")
@@ -41,7 +43,7 @@ func TestCreate(t *testing.T) {
 		{
 			name: "ok create counter",
 			mock: func(args args) {
-				mock.ExpectExec("INSERT INTO metrics").WithArgs(args.m.ID, args.m.MType, *args.m.Delta).
+				mock.ExpectExec("INSERT INTO metrics").WithArgs(args.m.ID, args.m.MType, *args.m.Delta, "").
 					WillReturnResult(sqlmock.NewResult(1, 1))
 			},
 			input: args{ctx: ctx, m: models.Metrics{MType: models.CounterType, ID: "name1", Delta: &delta}},
@@ -49,7 +51,7 @@ func TestCreate(t *testing.T) {
 		{
 			name: "ok create gauge",
 			mock: func(args args) {
-				mock.ExpectExec("INSERT INTO metrics").WithArgs(args.m.ID, args.m.MType, *args.m.Value).
+				mock.ExpectExec("INSERT INTO metrics").WithArgs(args.m.ID, args.m.MType, *args.m.Value, "").
 					WillReturnResult(sqlmock.NewResult(1, 1))
 			},
 			input: args{ctx: ctx, m: models.Metrics{MType: models.GaugeType, ID: "name1", Value: &value}},
@@ -57,7 +59,7 @@ func TestCreate(t *testing.T) {
 		{
 			name: "insertion error",
 			mock: func(args args) {
-				mock.ExpectExec("INSERT INTO metrics").WithArgs(args.m.ID, args.m.MType, *args.m.Value).
+				mock.ExpectExec("INSERT INTO metrics").WithArgs(args.m.ID, args.m.MType, *args.m.Value, "").
 					WillReturnError(ErrTest)
 			},
 			input:   args{ctx: ctx, m: models.Metrics{MType: models.GaugeType, ID: "name1", Value: &value}},
@@ -104,18 +106,19 @@ func TestGet(t *testing.T) {
 	value := float64(500)
 	type mockBehavior func(a args)
 	tests := []struct {
-		name    string
-		mock    mockBehavior
-		input   args
-		want    models.Metrics
-		wantErr bool
+		name     string
+		mock     mockBehavior
+		input    args
+		want     models.Metrics
+		wantErr  bool
+		notFound bool
 	}{
 		{
 			name: "ok conter",
 			mock: func(a args) {
-				rows := sqlmock.NewRows([]string{"delta", "value"}).AddRow(a.delta, nil)
-				mock.ExpectQuery("select (.+) from metrics where (.+) ORDER BY time DESC LIMIT 1;").
-					WithArgs(a.mID, a.mType).WillReturnRows(rows)
+				rows := sqlmock.NewRows([]string{"delta", "value", "time"}).AddRow(a.delta, nil, time.Now().UTC())
+				mock.ExpectQuery("select (.+) from metrics_latest where (.+);").
+					WithArgs(a.mID, a.mType, "").WillReturnRows(rows)
 			},
 			input: args{
 				ctx:   ctx,
@@ -128,9 +131,9 @@ func TestGet(t *testing.T) {
 		{
 			name: "ok gauge",
 			mock: func(a args) {
-				rows := sqlmock.NewRows([]string{"delta", "value"}).AddRow(nil, a.value)
-				mock.ExpectQuery("select (.+) from metrics where (.+) ORDER BY time DESC LIMIT 1;").
-					WithArgs(a.mID, a.mType).WillReturnRows(rows)
+				rows := sqlmock.NewRows([]string{"delta", "value", "time"}).AddRow(nil, a.value, time.Now().UTC())
+				mock.ExpectQuery("select (.+) from metrics_latest where (.+);").
+					WithArgs(a.mID, a.mType, "").WillReturnRows(rows)
 			},
 			input: args{
 				ctx:   ctx,
@@ -143,8 +146,8 @@ func TestGet(t *testing.T) {
 		{
 			name: "selection error",
 			mock: func(a args) {
-				mock.ExpectQuery("select (.+) from metrics where (.+) ORDER BY time DESC LIMIT 1;").
-					WithArgs(a.mID, a.mType).WillReturnError(ErrTest)
+				mock.ExpectQuery("select (.+) from metrics_latest where (.+);").
+					WithArgs(a.mID, a.mType, "").WillReturnError(ErrTest)
 			},
 			input: args{
 				ctx:   ctx,
@@ -154,6 +157,21 @@ func TestGet(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "not found",
+			mock: func(a args) {
+				rows := sqlmock.NewRows([]string{"delta", "value", "time"})
+				mock.ExpectQuery("select (.+) from metrics_latest where (.+);").
+					WithArgs(a.mID, a.mType, "").WillReturnRows(rows)
+			},
+			input: args{
+				ctx:   ctx,
+				mType: models.GaugeType,
+				mID:   "name1",
+			},
+			wantErr:  true,
+			notFound: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -163,6 +181,7 @@ func TestGet(t *testing.T) {
 			got, err := r.Get(tt.input.ctx, tt.input.mType, tt.input.mID)
 			if tt.wantErr {
 				assert.Error(t, err)
+				assert.Equal(t, tt.notFound, errors.Is(err, repository.ErrNotFound))
 			} else {
 				assert.NoError(t, err)
 				assert.Equal(t, tt.want, got)
@@ -199,11 +218,11 @@ func TestGetAll(t *testing.T) {
 		{
 			name: "ok",
 			mock: func() {
-				rows := sqlmock.NewRows([]string{"name", "type", "delta", "value"}).
-					AddRow("name1", "counter", int64(500), nil).
-					AddRow("name1", "gauge", nil, float64(500))
-				mock.ExpectQuery(`SELECT (.+) FROM (.+) AS t1 LEFT JOIN metrics AS m ON (.+);`).
-					WithoutArgs().WillReturnRows(rows)
+				rows := sqlmock.NewRows([]string{"name", "type", "delta", "value", "time"}).
+					AddRow("name1", "counter", int64(500), nil, time.Now().UTC()).
+					AddRow("name1", "gauge", nil, float64(500), time.Now().UTC())
+				mock.ExpectQuery(`SELECT (.+) FROM metrics_latest WHERE tenant=\$1;`).
+					WithArgs("").WillReturnRows(rows)
 			},
 			input: ctx,
 			want:  []models.Metrics{counter, gauge},
@@ -211,8 +230,8 @@ func TestGetAll(t *testing.T) {
 		{
 			name: "selection error",
 			mock: func() {
-				mock.ExpectQuery(`SELECT (.+) FROM (.+) AS t1 LEFT JOIN metrics AS m ON (.+);`).
-					WithoutArgs().WillReturnError(ErrTest)
+				mock.ExpectQuery(`SELECT (.+) FROM metrics_latest WHERE tenant=\$1;`).
+					WithArgs("").WillReturnError(ErrTest)
 			},
 			input:   ctx,
 			wantErr: true,
@@ -262,9 +281,9 @@ func TestLoad(t *testing.T) {
 			name: "ok",
 			mock: func() {
 				mock.ExpectBegin()
-				mock.ExpectExec("INSERT INTO metrics").WithArgs("name1", models.CounterType, delta).
+				mock.ExpectExec("INSERT INTO metrics").WithArgs("name1", models.CounterType, delta, "").
 					WillReturnResult(sqlmock.NewResult(1, 1))
-				mock.ExpectExec("INSERT INTO metrics").WithArgs("name1", models.GaugeType, value).
+				mock.ExpectExec("INSERT INTO metrics").WithArgs("name1", models.GaugeType, value, "").
 					WillReturnResult(sqlmock.NewResult(1, 1))
 				mock.ExpectCommit()
 			},
@@ -274,11 +293,12 @@ func TestLoad(t *testing.T) {
 			name: "insertion error",
 			mock: func() {
 				mock.ExpectBegin()
-				mock.ExpectExec("INSERT INTO metrics").WithArgs("name1", models.CounterType, delta).
+				mock.ExpectExec("INSERT INTO metrics").WithArgs("name1", models.CounterType, delta, "").
 					WillReturnError(ErrTest)
 				mock.ExpectRollback()
 			},
-			input: ctx,
+			input:   ctx,
+			wantErr: true,
 		},
 	}
 
@@ -297,3 +317,68 @@ func TestLoad(t *testing.T) {
 	}
 	_ = mockDB.Close()
 }
+
+func TestPurge(t *testing.T) {
+	_ = logger.InitLogger()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	sqlxDB := sqlx.NewDb(mockDB, "sqlmock")
+
+	r := Storage{db: sqlxDB}
+	ctx := context.Background()
+	before := time.Now()
+
+	mock.ExpectExec("WITH expired AS \\(DELETE FROM metrics_latest (.+)\\) DELETE FROM metrics").
+		WithArgs(models.GaugeType, before.UTC()).WillReturnResult(sqlmock.NewResult(0, 3))
+	err = r.Purge(ctx, models.GaugeType, before)
+	assert.NoError(t, err)
+
+	mock.ExpectExec("DELETE FROM metrics").
+		WithArgs(models.GaugeType, before.UTC()).WillReturnError(ErrTest)
+	err = r.Purge(ctx, models.GaugeType, before)
+	assert.Error(t, err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	_ = mockDB.Close()
+}
+
+func TestStale(t *testing.T) {
+	r := Storage{ttl: map[string]time.Duration{models.GaugeType: time.Minute}}
+	value := float64(500)
+
+	m := r.stale(models.Metrics{MType: models.GaugeType, ID: "name1", Value: &value}, time.Now().UTC())
+	assert.False(t, m.Stale)
+	m = r.stale(models.Metrics{MType: models.GaugeType, ID: "name1", Value: &value}, time.Now().UTC().Add(-time.Hour))
+	assert.True(t, m.Stale)
+	m = r.stale(models.Metrics{MType: models.CounterType, ID: "name1", Value: &value}, time.Now().UTC().Add(-time.Hour))
+	assert.False(t, m.Stale)
+}
+
+func TestIncrement(t *testing.T) {
+	_ = logger.InitLogger()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	sqlxDB := sqlx.NewDb(mockDB, "sqlmock")
+
+	r := Storage{db: sqlxDB}
+	ctx := context.Background()
+	total := int64(750)
+
+	mock.ExpectQuery("INSERT INTO metrics_latest (.+) ON CONFLICT (.+) DO UPDATE SET delta = metrics_latest.delta \\+ EXCLUDED.delta").
+		WithArgs("name1", models.CounterType, int64(250), "").
+		WillReturnRows(sqlmock.NewRows([]string{"delta"}).AddRow(total))
+	got, err := r.Increment(ctx, "name1", 250)
+	assert.NoError(t, err)
+	assert.Equal(t, models.Metrics{MType: models.CounterType, ID: "name1", Delta: &total}, got)
+
+	mock.ExpectQuery("INSERT INTO metrics_latest").WillReturnError(ErrTest)
+	_, err = r.Increment(ctx, "name1", 250)
+	assert.Error(t, err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	_ = mockDB.Close()
+}
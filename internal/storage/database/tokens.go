@@ -0,0 +1,123 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/auth"
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+)
+
+// Tokens keeps API tokens in the database. Since every request looks its
+// token up, found tokens are cached for ttl; a token revoked on another
+// server is refused here once its entry expires.
+type Tokens struct {
+	db    *sqlx.DB
+	ttl   time.Duration
+	cache map[string]cachedToken
+	mx    sync.Mutex
+}
+
+type cachedToken struct {
+	token   auth.Token
+	expires time.Time
+}
+
+// NewTokens keeps tokens in db, whose schema is expected to be migrated.
+func NewTokens(db *sqlx.DB, ttl time.Duration) *Tokens {
+	return &Tokens{db: db, ttl: ttl, cache: make(map[string]cachedToken)}
+}
+
+func (s *Tokens) Find(ctx context.Context, hash string) (auth.Token, error) {
+	now := time.Now()
+	s.mx.Lock()
+	c, ok := s.cache[hash]
+	if ok && now.After(c.expires) {
+		delete(s.cache, hash)
+		ok = false
+	}
+	s.mx.Unlock()
+	if ok {
+		return c.token, nil
+	}
+
+	t, err := s.find(ctx, hash)
+	if err != nil || s.ttl <= 0 {
+		return t, err
+	}
+	s.mx.Lock()
+	s.cache[hash] = cachedToken{token: t, expires: now.Add(s.ttl)}
+	s.mx.Unlock()
+	return t, nil
+}
+
+func (s *Tokens) find(ctx context.Context, hash string) (auth.Token, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT id, scopes, tenant, created FROM api_tokens WHERE hash=$1;`, hash)
+	t := auth.Token{Hash: hash}
+	var scopes string
+	err := row.Scan(&t.ID, &scopes, &t.Tenant, &t.Created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return auth.Token{}, auth.ErrNotFound
+	}
+	if err != nil {
+		return auth.Token{}, err
+	}
+	t.Scopes = strings.Split(scopes, ",")
+	return t, nil
+}
+
+func (s *Tokens) Save(ctx context.Context, t auth.Token) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO api_tokens (id, hash, scopes, tenant, created) VALUES ($1, $2, $3, $4, $5);`,
+		t.ID, t.Hash, strings.Join(t.Scopes, ","), t.Tenant, t.Created)
+	return err
+}
+
+func (s *Tokens) Revoke(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM api_tokens WHERE id=$1;`, id)
+	if err != nil {
+		return err
+	}
+	s.mx.Lock()
+	for hash, c := range s.cache {
+		if c.token.ID == id {
+			delete(s.cache, hash)
+		}
+	}
+	s.mx.Unlock()
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return auth.ErrNotFound
+	}
+	return nil
+}
+
+func (s *Tokens) List(ctx context.Context) ([]auth.Token, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, scopes, tenant, created FROM api_tokens ORDER BY created;`)
+	if err != nil {
+		return nil, err
+	}
+	tokens := []auth.Token{}
+	for rows.Next() {
+		var t auth.Token
+		var scopes string
+		err = rows.Scan(&t.ID, &scopes, &t.Tenant, &t.Created)
+		if err != nil {
+			logger.LogErrorIfNotNil(rows.Close())
+			return nil, err
+		}
+		t.Scopes = strings.Split(scopes, ",")
+		tokens = append(tokens, t)
+	}
+	err = rows.Close()
+	logger.LogErrorIfNotNil(err)
+	return tokens, rows.Err()
+}
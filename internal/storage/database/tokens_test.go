@@ -0,0 +1,76 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/auth"
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+)
+
+func TestTokens(t *testing.T) {
+	_ = logger.InitLogger()
+	mockDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	s := Tokens{db: sqlx.NewDb(mockDB, "sqlmock")}
+	ctx := context.Background()
+	created := time.Now().UTC()
+
+	mock.ExpectExec("INSERT INTO api_tokens").WithArgs("id1", "hash1", "read,write", "a", created).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	err = s.Save(ctx, auth.Token{ID: "id1", Hash: "hash1", Scopes: []string{"read", "write"}, Tenant: "a", Created: created})
+	require.NoError(t, err)
+
+	mock.ExpectQuery("SELECT (.+) FROM api_tokens WHERE hash=\\$1;").WithArgs("hash1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "scopes", "tenant", "created"}).AddRow("id1", "read,write", "a", created))
+	found, err := s.Find(ctx, "hash1")
+	require.NoError(t, err)
+	assert.Equal(t, auth.Token{ID: "id1", Hash: "hash1", Scopes: []string{"read", "write"}, Tenant: "a", Created: created}, found)
+
+	mock.ExpectQuery("SELECT (.+) FROM api_tokens WHERE hash=\\$1;").WithArgs("unknown").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "scopes", "tenant", "created"}))
+	_, err = s.Find(ctx, "unknown")
+	assert.ErrorIs(t, err, auth.ErrNotFound)
+
+	mock.ExpectExec("DELETE FROM api_tokens").WithArgs("id1").WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, s.Revoke(ctx, "id1"))
+	mock.ExpectExec("DELETE FROM api_tokens").WithArgs("id1").WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.ErrorIs(t, s.Revoke(ctx, "id1"), auth.ErrNotFound)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTokensCache(t *testing.T) {
+	_ = logger.InitLogger()
+	mockDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	s := NewTokens(sqlx.NewDb(mockDB, "sqlmock"), time.Minute)
+	ctx := context.Background()
+	created := time.Now().UTC()
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "scopes", "tenant", "created"}).AddRow("id1", "read", "", created)
+	}
+
+	mock.ExpectQuery("SELECT (.+) FROM api_tokens WHERE hash=\\$1;").WithArgs("hash1").WillReturnRows(rows())
+	for i := 0; i < 3; i++ {
+		found, err := s.Find(ctx, "hash1")
+		require.NoError(t, err)
+		assert.Equal(t, "id1", found.ID)
+	}
+	require.NoError(t, mock.ExpectationsWereMet(), "the token is looked up once")
+
+	mock.ExpectExec("DELETE FROM api_tokens").WithArgs("id1").WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, s.Revoke(ctx, "id1"))
+	mock.ExpectQuery("SELECT (.+) FROM api_tokens WHERE hash=\\$1;").WithArgs("hash1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "scopes", "tenant", "created"}))
+	_, err = s.Find(ctx, "hash1")
+	assert.ErrorIs(t, err, auth.ErrNotFound, "a revoked token leaves the cache")
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/config"
+	"github.com/dkrasnykh/metrics-alerter/internal/idempotency"
+	"github.com/dkrasnykh/metrics-alerter/internal/repository"
+	"github.com/dkrasnykh/metrics-alerter/internal/storage/database"
+)
+
+// NewIdempotency returns nil when idempotency keys are ignored. A database
+// store shares the connections of r.
+func NewIdempotency(c *config.ServerConfig, r repository.Storager) (idempotency.Store, error) {
+	ttl := time.Duration(c.IdempotencyTTL) * time.Second
+	switch c.IdempotencyStore {
+	case ``:
+		return nil, nil
+	case `memory`:
+		return idempotency.NewCache(ttl, c.IdempotencyCache), nil
+	case `database`:
+		if c.DatabaseDSN == `` {
+			return nil, fmt.Errorf("idempotency store %s requires DATABASE_DSN", c.IdempotencyStore)
+		}
+		db, err := pool(c, r)
+		if err != nil {
+			return nil, err
+		}
+		return database.NewIdempotency(db, ttl), nil
+	default:
+		return nil, fmt.Errorf("unknown idempotency store %s", c.IdempotencyStore)
+	}
+}
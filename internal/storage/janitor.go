@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+	"github.com/dkrasnykh/metrics-alerter/internal/repository"
+)
+
+func RunJanitor(ctx context.Context, r repository.Storager, ttl map[string]time.Duration, retention, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			Expire(ctx, r, ttl, retention, t)
+		}
+	}
+}
+
+func Expire(ctx context.Context, r repository.Storager, ttl map[string]time.Duration, retention time.Duration, now time.Time) {
+	for mType, d := range ttl {
+		if d <= 0 {
+			continue
+		}
+		err := r.Purge(ctx, mType, now.Add(-(d + retention)))
+		if err != nil {
+			logger.Error(fmt.Sprintf("purging expired %s metrics: %s", mType, err.Error()))
+		}
+	}
+}
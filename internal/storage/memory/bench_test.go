@@ -0,0 +1,86 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+)
+
+func TestConsistentGetAll(t *testing.T) {
+	ctx := context.Background()
+	s := NewSharded("", 0, 8)
+	delta := int64(1)
+	batch := make([]models.Metrics, 0, 16)
+	for i := 0; i < 16; i++ {
+		batch = append(batch, models.Metrics{MType: models.CounterType, ID: fmt.Sprintf("c%d", i), Delta: &delta})
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				assert.NoError(t, s.Load(ctx, batch))
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		ms, err := s.GetAll(ctx)
+		require.NoError(t, err)
+		for _, m := range ms {
+			assert.Equal(t, *ms[0].Delta, *m.Delta)
+		}
+	}
+	wg.Wait()
+}
+
+func BenchmarkParallelIncrement(b *testing.B) {
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprintf("%d shards", shards), func(b *testing.B) {
+			s := NewSharded("", 0, shards)
+			ctx := context.Background()
+			var n atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				name := fmt.Sprintf("counter%d", n.Add(1))
+				for pb.Next() {
+					_, err := s.Increment(ctx, name, 1)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkParallelLoad(b *testing.B) {
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprintf("%d shards", shards), func(b *testing.B) {
+			s := NewSharded("", 0, shards)
+			ctx := context.Background()
+			var n atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				agent := n.Add(1)
+				metrics := make([]models.Metrics, 0, 32)
+				for i := 0; i < 32; i++ {
+					v := float64(i)
+					metrics = append(metrics, models.Metrics{MType: models.GaugeType, ID: fmt.Sprintf("agent%d_gauge%d", agent, i), Value: &v})
+				}
+				for pb.Next() {
+					err := s.Load(ctx, metrics)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -1,22 +1,38 @@
 package memory
 
 import (
-	"context"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 
 	"github.com/dkrasnykh/metrics-alerter/internal/logger"
-	"github.com/dkrasnykh/metrics-alerter/internal/models"
-	"github.com/dkrasnykh/metrics-alerter/internal/repository"
 )
 
+const snapshotVersion = 1
+
 type data struct {
-	Metrics []models.Metrics `json:"metrics"`
+	Metrics []Entry `json:"metrics"`
+}
+
+type header struct {
+	Version  int    `json:"version"`
+	Checksum string `json:"checksum"`
+	Gzip     bool   `json:"gzip,omitempty"`
+}
+
+type SnapshotOptions struct {
+	Compress bool
+	Keep     int
 }
 
-func Load(path string) ([]models.Metrics, error) {
+func Load(path string) ([]Entry, error) {
 	_, err := os.Stat(path)
 	if err != nil {
 		return nil, err
@@ -29,54 +45,159 @@ func Load(path string) ([]models.Metrics, error) {
 	if len(bytes) == 0 {
 		return nil, fmt.Errorf(`file %s is empty`, path)
 	}
+	payload, err := decode(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot %s: %w", path, err)
+	}
 	v := data{}
-	err = json.Unmarshal(bytes, &v)
+	err = json.Unmarshal(payload, &v)
 	if err != nil {
 		return nil, err
 	}
 	return v.Metrics, nil
 }
 
-func Save(path string, ms []models.Metrics) error {
-	file, err := os.Create(path)
+func Save(path string, ms []Entry, opts SnapshotOptions) error {
+	v := data{ms}
+	payload, err := json.Marshal(&v)
+	if err != nil {
+		return fmt.Errorf("error converting data to json %w", err)
+	}
+	buf, err := encode(payload, opts.Compress)
 	if err != nil {
 		return err
 	}
-	defer func(file *os.File) {
-		err := file.Close()
-		logger.LogErrorIfNotNil(err)
-	}(file)
-	v := data{ms}
-	bytes, err := json.Marshal(&v)
+	tmp := path + ".new"
+	err = writeSynced(tmp, buf)
 	if err != nil {
-		return fmt.Errorf("error converting data to json %w", err)
+		return fmt.Errorf("error writing data into file %s; %w", tmp, err)
+	}
+	for i := opts.Keep - 1; i > 0; i-- {
+		err = os.Rename(snapshotPath(path, i-1), snapshotPath(path, i))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
 	}
-	_, err = file.Write(bytes)
+	err = os.Rename(tmp, path)
 	if err != nil {
-		return fmt.Errorf("error writing data into file %s; %w", path, err)
+		return err
 	}
-	return nil
+	return syncDir(filepath.Dir(path))
 }
 
 func InitDir(path string) string {
+	if path == "" {
+		return ""
+	}
 	err := os.MkdirAll(path+"/", 0777)
 	logger.LogErrorIfNotNil(err)
 	return path + "/metrics.tmp"
 }
 
-func Restore(r repository.Storager, path string) error {
+func Restore(s *Storage, path string) error {
 	if path == "" {
 		return errors.New("the path is undefined")
 	}
-	data, err := Load(path + "/metrics.tmp")
+	file := path + "/metrics.tmp"
+	var data []Entry
+	var err error
+	for i := 0; ; i++ {
+		p := snapshotPath(file, i)
+		if i > 0 {
+			if _, statErr := os.Stat(p); statErr != nil {
+				break
+			}
+			logger.Error(fmt.Sprintf("falling back to snapshot %s: %s", p, err.Error()))
+		}
+		data, err = Load(p)
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return err
 	}
-	for _, m := range data {
-		_, err = r.Create(context.Background(), m)
+	s.Import(data)
+	return nil
+}
+
+func snapshotPath(path string, generation int) string {
+	if generation == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%d", path, generation)
+}
+
+func encode(payload []byte, compress bool) ([]byte, error) {
+	if compress {
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		_, err := gz.Write(payload)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		err = gz.Close()
+		if err != nil {
+			return nil, err
+		}
+		payload = b.Bytes()
 	}
-	return nil
+	sum := sha256.Sum256(payload)
+	h, err := json.Marshal(header{Version: snapshotVersion, Checksum: hex.EncodeToString(sum[:]), Gzip: compress})
+	if err != nil {
+		return nil, err
+	}
+	return append(append(h, '\n'), payload...), nil
+}
+
+func decode(buf []byte) ([]byte, error) {
+	line, payload, found := bytes.Cut(buf, []byte("\n"))
+	var h header
+	if !found || json.Unmarshal(line, &h) != nil || h.Version == 0 {
+		// snapshots written before the header was introduced hold bare json
+		return buf, nil
+	}
+	if h.Version > snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", h.Version)
+	}
+	sum := sha256.Sum256(payload)
+	if hex.EncodeToString(sum[:]) != h.Checksum {
+		return nil, errors.New("snapshot checksum mismatch")
+	}
+	if !h.Gzip {
+		return payload, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(gz)
+}
+
+func writeSynced(path string, buf []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(buf)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		logger.LogErrorIfNotNil(file.Close())
+		return err
+	}
+	return file.Close()
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func(dir *os.File) {
+		err := dir.Close()
+		logger.LogErrorIfNotNil(err)
+	}(dir)
+	return dir.Sync()
 }
@@ -0,0 +1,110 @@
+package memory
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/tenant"
+)
+
+func TestSaveLoad(t *testing.T) {
+	_ = logger.InitLogger()
+	for _, compress := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "metrics.tmp")
+		entries := []Entry{{Metrics: mCounter}, {Tenant: "a", Metrics: mGauge}}
+		err := Save(path, entries, SnapshotOptions{Compress: compress})
+		require.NoError(t, err)
+
+		ms, err := Load(path)
+		require.NoError(t, err)
+		assert.Equal(t, entries, ms)
+		_, err = os.Stat(path + ".new")
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestLoadLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.tmp")
+	err := os.WriteFile(path, []byte(`{"metrics":[{"id":"name1","type":"counter","delta":500}]}`), 0666)
+	require.NoError(t, err)
+
+	ms, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, []Entry{{Metrics: mCounter}}, ms)
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.tmp")
+	err := Save(path, []Entry{{Metrics: mCounter}}, SnapshotOptions{})
+	require.NoError(t, err)
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	err = os.WriteFile(path, buf[:len(buf)-5], 0666)
+	require.NoError(t, err)
+
+	_, err = Load(path)
+	assert.Error(t, err)
+}
+
+func TestRestoreFallback(t *testing.T) {
+	_ = logger.InitLogger()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.tmp")
+	opts := SnapshotOptions{Compress: true, Keep: 2}
+
+	older := int64(100)
+	err := Save(path, []Entry{{Metrics: models.Metrics{MType: models.CounterType, ID: "name1", Delta: &older}}}, opts)
+	require.NoError(t, err)
+	err = Save(path, []Entry{{Metrics: mCounter}, {Tenant: "a", Metrics: mGauge}}, opts)
+	require.NoError(t, err)
+	err = Save(path, []Entry{{Metrics: mCounter}, {Metrics: mGauge}}, opts)
+	require.NoError(t, err)
+	_, err = os.Stat(path + ".2")
+	assert.True(t, os.IsNotExist(err))
+
+	err = os.WriteFile(path, []byte{}, 0666)
+	require.NoError(t, err)
+
+	s := New("", 0)
+	err = Restore(s, dir)
+	require.NoError(t, err)
+	ms, err := s.GetAll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []models.Metrics{mCounter}, ms)
+	ms, err = s.GetAll(tenant.WithID(context.Background(), "a"))
+	require.NoError(t, err)
+	assert.Equal(t, []models.Metrics{mGauge}, ms)
+}
+
+func TestRestoreUpdated(t *testing.T) {
+	_ = logger.InitLogger()
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Hour).UTC()
+	err := Save(filepath.Join(dir, "metrics.tmp"), []Entry{{Metrics: mGauge, Updated: old}, {Metrics: mCounter}},
+		SnapshotOptions{})
+	require.NoError(t, err)
+
+	s := New("", 0)
+	s.SetTTL(map[string]time.Duration{models.GaugeType: time.Minute, models.CounterType: time.Minute})
+	err = Restore(s, dir)
+	require.NoError(t, err)
+	m, err := s.Get(context.Background(), models.GaugeType, mGauge.ID)
+	require.NoError(t, err)
+	assert.True(t, m.Stale, "the metric stays as old as it was when saved")
+	m, err = s.Get(context.Background(), models.CounterType, mCounter.ID)
+	require.NoError(t, err)
+	assert.False(t, m.Stale, "an entry saved without a time counts as updated now")
+	for _, e := range s.Dump() {
+		if e.MType == models.GaugeType {
+			assert.Equal(t, old, e.Updated.UTC(), "the time is saved again as restored")
+		}
+	}
+}
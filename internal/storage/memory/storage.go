@@ -5,105 +5,339 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dkrasnykh/metrics-alerter/internal/logger"
 	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/repository"
+	"github.com/dkrasnykh/metrics-alerter/internal/tenant"
 )
 
 type Key struct {
-	MType string
-	ID    string
+	Tenant string
+	MType  string
+	ID     string
+}
+
+type Entry struct {
+	Tenant string `json:"tenant,omitempty"`
+	models.Metrics
+	Updated time.Time `json:"updated"`
 }
 
 type Value struct {
-	Value float64
-	Delta int64
+	Value   float64
+	Delta   int64
+	Updated time.Time
+}
+
+const DefaultShards = 32
+
+type shard struct {
+	storage map[Key]Value
+	mx      sync.RWMutex
 }
 
 type Storage struct {
-	storage           map[Key]Value
+	shards            []*shard
 	filePath          string
 	fileStoreInterval int
-	mx                sync.RWMutex
+	ttl               map[string]time.Duration
+	snapshot          SnapshotOptions
+	dirty             atomic.Bool
+	fileMx            sync.Mutex
+	done              chan struct{}
 }
 
 func New(path string, interval int) *Storage {
-	return &Storage{
-		storage:           make(map[Key]Value),
+	return NewSharded(path, interval, DefaultShards)
+}
+
+func NewSharded(path string, interval int, shards int) *Storage {
+	if shards < 1 {
+		shards = 1
+	}
+	s := &Storage{
+		shards:            make([]*shard, shards),
 		filePath:          InitDir(path),
 		fileStoreInterval: interval,
-		mx:                sync.RWMutex{},
+		ttl:               map[string]time.Duration{},
+		done:              make(chan struct{}),
+	}
+	for i := range s.shards {
+		s.shards[i] = &shard{storage: make(map[Key]Value)}
 	}
+	if s.filePath != "" && s.fileStoreInterval > 0 {
+		go s.flushLoop(time.Duration(s.fileStoreInterval) * time.Second)
+	}
+	return s
 }
 
 func (s *Storage) Create(ctx context.Context, m models.Metrics) (models.Metrics, error) {
-	s.mx.Lock()
-	defer s.mx.Unlock()
+	k := Key{tenant.ID(ctx), m.MType, m.ID}
+	sh := s.shard(k)
+	sh.mx.Lock()
+	sh.storage[k] = Value{valueOrDefault(m.Value), deltaOrDefault(m.Delta), time.Now()}
+	sh.mx.Unlock()
 
-	k := Key{m.MType, m.ID}
-	v := Value{valueOrDefault(m.Value), deltaOrDefault(m.Delta)}
-	s.storage[k] = v
+	s.changed()
+	return m, nil
+}
 
-	s.StoreIntoFile()
+func (s *Storage) Increment(ctx context.Context, name string, delta int64) (models.Metrics, error) {
+	k := Key{tenant.ID(ctx), models.CounterType, name}
+	sh := s.shard(k)
+	sh.mx.Lock()
+	v := sh.storage[k]
+	v.Delta += delta
+	v.Updated = time.Now()
+	sh.storage[k] = v
+	m := s.metric(k, v)
+	sh.mx.Unlock()
 
+	s.changed()
 	return m, nil
 }
 
 func (s *Storage) Get(ctx context.Context, mType, mName string) (models.Metrics, error) {
-	s.mx.RLock()
-	defer s.mx.RUnlock()
+	k := Key{tenant.ID(ctx), mType, mName}
+	sh := s.shard(k)
+	sh.mx.RLock()
+	defer sh.mx.RUnlock()
 
-	k := Key{mType, mName}
-	v, ok := s.storage[k]
+	v, ok := sh.storage[k]
 	if !ok {
-		return models.Metrics{}, fmt.Errorf("value by %s type and %s name not found", mType, mName)
+		return models.Metrics{}, fmt.Errorf("value by %s type and %s name: %w", mType, mName, repository.ErrNotFound)
 	}
-	return getMetric(k.MType, k.ID, v.Value, v.Delta), nil
+	return s.metric(k, v), nil
 }
 
 func (s *Storage) GetAll(ctx context.Context) ([]models.Metrics, error) {
-	s.mx.RLock()
-	defer s.mx.RUnlock()
+	for _, sh := range s.shards {
+		sh.mx.RLock()
+	}
+	defer func() {
+		for _, sh := range s.shards {
+			sh.mx.RUnlock()
+		}
+	}()
 
-	ms := make([]models.Metrics, 0, len(s.storage))
-	for k, v := range s.storage {
-		ms = append(ms, getMetric(k.MType, k.ID, v.Value, v.Delta))
+	size := 0
+	for _, sh := range s.shards {
+		size += len(sh.storage)
+	}
+	id := tenant.ID(ctx)
+	ms := make([]models.Metrics, 0, size)
+	for _, sh := range s.shards {
+		for k, v := range sh.storage {
+			if k.Tenant == id {
+				ms = append(ms, s.metric(k, v))
+			}
+		}
 	}
 	return ms, nil
 }
 
+// Dump returns the metrics of every tenant.
+func (s *Storage) Dump() []Entry {
+	for _, sh := range s.shards {
+		sh.mx.RLock()
+	}
+	defer func() {
+		for _, sh := range s.shards {
+			sh.mx.RUnlock()
+		}
+	}()
+
+	entries := make([]Entry, 0)
+	for _, sh := range s.shards {
+		for k, v := range sh.storage {
+			entries = append(entries, Entry{Tenant: k.Tenant, Metrics: s.metric(k, v), Updated: v.Updated})
+		}
+	}
+	return entries
+}
+
 func (s *Storage) Load(ctx context.Context, metrics []models.Metrics) error {
-	s.mx.Lock()
-	defer s.mx.Unlock()
+	id := tenant.ID(ctx)
+	batches := make([][]models.Metrics, len(s.shards))
+	for _, m := range metrics {
+		i := s.index(Key{Tenant: id, MType: m.MType, ID: m.ID})
+		batches[i] = append(batches[i], m)
+	}
+	// every touched shard is held until the whole batch is applied, so that
+	// GetAll never observes half of it
+	for i, batch := range batches {
+		if len(batch) > 0 {
+			s.shards[i].mx.Lock()
+		}
+	}
+	now := time.Now()
+	for i, batch := range batches {
+		sh := s.shards[i]
+		for _, m := range batch {
+			key := Key{Tenant: id, MType: m.MType, ID: m.ID}
+			value := Value{Value: valueOrDefault(m.Value), Delta: deltaOrDefault(m.Delta), Updated: now}
+			if m.MType == models.CounterType {
+				value.Delta += sh.storage[key].Delta
+			}
+			sh.storage[key] = value
+		}
+	}
+	for i, batch := range batches {
+		if len(batch) > 0 {
+			s.shards[i].mx.Unlock()
+		}
+	}
 
+	s.changed()
+	return nil
+}
+
+// Import puts back dumped entries with the time each was last updated, so a
+// restored metric goes stale when it would have; entries dumped without one
+// count as updated now.
+func (s *Storage) Import(entries []Entry) {
+	now := time.Now()
+	for _, e := range entries {
+		k := Key{e.Tenant, e.MType, e.ID}
+		updated := e.Updated
+		if updated.IsZero() {
+			updated = now
+		}
+		sh := s.shard(k)
+		sh.mx.Lock()
+		sh.storage[k] = Value{valueOrDefault(e.Value), deltaOrDefault(e.Delta), updated}
+		sh.mx.Unlock()
+	}
+
+	s.changed()
+}
+
+// Touch sets when the tenant's metrics were last updated, for changes applied
+// after the fact.
+func (s *Storage) Touch(ctx context.Context, metrics []models.Metrics, at time.Time) {
+	id := tenant.ID(ctx)
 	for _, m := range metrics {
-		key := Key{MType: m.MType, ID: m.ID}
-		value := Value{Value: valueOrDefault(m.Value), Delta: deltaOrDefault(m.Delta)}
-		s.storage[key] = value
+		k := Key{id, m.MType, m.ID}
+		sh := s.shard(k)
+		sh.mx.Lock()
+		if v, ok := sh.storage[k]; ok {
+			v.Updated = at
+			sh.storage[k] = v
+		}
+		sh.mx.Unlock()
 	}
+}
+
+func (s *Storage) Purge(ctx context.Context, mType string, before time.Time) error {
+	purged := false
+	for _, sh := range s.shards {
+		sh.mx.Lock()
+		for k, v := range sh.storage {
+			if k.MType == mType && v.Updated.Before(before) {
+				delete(sh.storage, k)
+				purged = true
+			}
+		}
+		sh.mx.Unlock()
+	}
+
+	if !purged {
+		return nil
+	}
+	s.changed()
 	return nil
 }
 
+func (s *Storage) SetTTL(ttl map[string]time.Duration) {
+	for _, sh := range s.shards {
+		sh.mx.Lock()
+	}
+	s.ttl = ttl
+	for _, sh := range s.shards {
+		sh.mx.Unlock()
+	}
+}
+
 func (s *Storage) Ping(ctx context.Context) error {
 	return errors.New(`database is not used`)
 }
 
-func (s *Storage) StoreIntoFile() {
-	if s.filePath != "" {
-		timeDuration := time.Duration(s.fileStoreInterval) * time.Second
-		time.AfterFunc(timeDuration, func() {
-			checker := func(err error) {
-				if err != nil {
-					logger.Error(err.Error())
-				}
-			}
-			ms, err := s.GetAll(context.Background())
-			checker(err)
-			err = Save(s.filePath, ms)
-			checker(err)
-		})
+func (s *Storage) Flush() error {
+	s.fileMx.Lock()
+	defer s.fileMx.Unlock()
+
+	if s.filePath == "" || !s.dirty.Swap(false) {
+		return nil
+	}
+	err := Save(s.filePath, s.Dump(), s.snapshot)
+	if err != nil {
+		s.dirty.Store(true)
+	}
+	return err
+}
+
+func (s *Storage) Close() error {
+	close(s.done)
+	return s.Flush()
+}
+
+// changed marks the storage dirty and, with synchronous backups, flushes it.
+// The write itself has been applied by then, so a failed flush is logged and
+// left to the next one rather than reported as a failed write.
+func (s *Storage) changed() {
+	if s.filePath == "" {
+		return
 	}
+	s.dirty.Store(true)
+	if s.fileStoreInterval == 0 {
+		logger.LogErrorIfNotNil(s.Flush())
+	}
+}
+
+func (s *Storage) flushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			logger.LogErrorIfNotNil(s.Flush())
+		}
+	}
+}
+
+func (s *Storage) SetSnapshotOptions(opts SnapshotOptions) {
+	s.fileMx.Lock()
+	defer s.fileMx.Unlock()
+
+	s.snapshot = opts
+}
+
+func (s *Storage) shard(k Key) *shard {
+	return s.shards[s.index(k)]
+}
+
+func (s *Storage) index(k Key) int {
+	h := uint32(2166136261)
+	for _, part := range [...]string{k.Tenant, "\x00", k.MType, "\x00", k.ID} {
+		for i := 0; i < len(part); i++ {
+			h ^= uint32(part[i])
+			h *= 16777619
+		}
+	}
+	return int(h % uint32(len(s.shards)))
+}
+
+func (s *Storage) metric(k Key, v Value) models.Metrics {
+	m := getMetric(k.MType, k.ID, v.Value, v.Delta)
+	if ttl := s.ttl[k.MType]; ttl > 0 {
+		m.Stale = time.Since(v.Updated) > ttl
+	}
+	return m
 }
 
 func deltaOrDefault(p *int64) int64 {
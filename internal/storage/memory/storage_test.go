@@ -2,13 +2,16 @@ package memory
 
 import (
 	"context"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/dkrasnykh/metrics-alerter/internal/logger"
 	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/tenant"
 )
 
 var (
@@ -74,3 +77,155 @@ func TestUpdate(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, delta, *value.Delta)
 }
+
+func TestStale(t *testing.T) {
+	_ = logger.InitLogger()
+	ctx := context.Background()
+	s := New("", 0)
+	s.SetTTL(map[string]time.Duration{models.CounterType: time.Minute})
+	_, err := s.Create(ctx, mCounter)
+	require.NoError(t, err)
+	_, err = s.Create(ctx, mGauge)
+	require.NoError(t, err)
+
+	value, err := s.Get(ctx, models.CounterType, `name1`)
+	require.NoError(t, err)
+	assert.False(t, value.Stale)
+
+	k := Key{MType: models.CounterType, ID: `name1`}
+	sh := s.shard(k)
+	v := sh.storage[k]
+	v.Updated = time.Now().Add(-2 * time.Minute)
+	sh.storage[k] = v
+
+	value, err = s.Get(ctx, models.CounterType, `name1`)
+	require.NoError(t, err)
+	assert.True(t, value.Stale)
+	value, err = s.Get(ctx, models.GaugeType, `name1`)
+	require.NoError(t, err)
+	assert.False(t, value.Stale)
+
+	err = s.Purge(ctx, models.CounterType, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	vals, err := s.GetAll(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []models.Metrics{mGauge}, vals)
+}
+
+func TestIncrement(t *testing.T) {
+	_ = logger.InitLogger()
+	ctx := context.Background()
+	s := New("", 0)
+	m, err := s.Increment(ctx, `name1`, 250)
+	require.NoError(t, err)
+	assert.Equal(t, int64(250), *m.Delta)
+	m, err = s.Increment(ctx, `name1`, 500)
+	require.NoError(t, err)
+	assert.Equal(t, int64(750), *m.Delta)
+
+	delta := int64(50)
+	err = s.Load(ctx, []models.Metrics{{MType: models.CounterType, ID: `name1`, Delta: &delta}})
+	require.NoError(t, err)
+	value, err := s.Get(ctx, models.CounterType, `name1`)
+	require.NoError(t, err)
+	assert.Equal(t, int64(800), *value.Delta)
+}
+
+func TestWriteThrough(t *testing.T) {
+	_ = logger.InitLogger()
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := New(dir, 0)
+	_, err := s.Create(ctx, mGauge)
+	require.NoError(t, err)
+	ms, err := Load(dir + "/metrics.tmp")
+	require.NoError(t, err)
+	require.Len(t, ms, 1)
+	assert.Equal(t, mGauge, ms[0].Metrics)
+	assert.False(t, ms[0].Updated.IsZero())
+
+	err = s.Load(ctx, []models.Metrics{mCounter})
+	require.NoError(t, err)
+	ms, err = Load(dir + "/metrics.tmp")
+	require.NoError(t, err)
+	assert.Len(t, ms, 2)
+}
+
+func TestPeriodicFlush(t *testing.T) {
+	_ = logger.InitLogger()
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := dir + "/metrics.tmp"
+	s := New(dir, 1)
+	defer func() {
+		require.NoError(t, s.Close())
+	}()
+
+	for i := 0; i < 100; i++ {
+		_, err := s.Increment(ctx, `name1`, 1)
+		require.NoError(t, err)
+	}
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, 3*time.Second, 100*time.Millisecond)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	time.Sleep(1500 * time.Millisecond)
+	idle, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, info.ModTime(), idle.ModTime())
+
+	ms, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), *ms[0].Delta)
+}
+
+func TestFailedFlush(t *testing.T) {
+	_ = logger.InitLogger()
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := New(dir, 0)
+	require.NoError(t, os.Mkdir(s.filePath+".new", 0700), "the snapshot cannot be written")
+
+	err := s.Load(ctx, []models.Metrics{mCounter})
+	require.NoError(t, err, "the write was applied although the backup failed")
+	m, err := s.Get(ctx, models.CounterType, mCounter.ID)
+	require.NoError(t, err)
+	assert.Equal(t, mdelta, *m.Delta)
+	assert.True(t, s.dirty.Load(), "the next flush tries again")
+}
+
+func TestTenants(t *testing.T) {
+	_ = logger.InitLogger()
+	ctx := context.Background()
+	ctxA := tenant.WithID(ctx, "a")
+	s := New("", 0)
+	_, err := s.Create(ctx, mCounter)
+	require.NoError(t, err)
+	_, err = s.Increment(ctxA, "name1", 1)
+	require.NoError(t, err)
+	err = s.Load(ctxA, []models.Metrics{mGauge})
+	require.NoError(t, err)
+
+	value, err := s.Get(ctx, models.CounterType, "name1")
+	require.NoError(t, err)
+	assert.Equal(t, mdelta, *value.Delta)
+	value, err = s.Get(ctxA, models.CounterType, "name1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), *value.Delta)
+	_, err = s.Get(ctx, models.GaugeType, "name1")
+	require.Error(t, err)
+
+	vals, err := s.GetAll(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []models.Metrics{mCounter}, vals)
+	vals, err = s.GetAll(ctxA)
+	require.NoError(t, err)
+	assert.Len(t, vals, 2)
+	assert.Len(t, s.Dump(), 3)
+}
@@ -3,6 +3,7 @@ package mocks
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	models "github.com/dkrasnykh/metrics-alerter/internal/models"
 	gomock "github.com/golang/mock/gomock"
@@ -46,6 +47,21 @@ func (mr *MockStoragerMockRecorder) Create(ctx, metric interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockStorager)(nil).Create), ctx, metric)
 }
 
+// Increment mocks base method.
+func (m *MockStorager) Increment(ctx context.Context, name string, delta int64) (models.Metrics, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Increment", ctx, name, delta)
+	ret0, _ := ret[0].(models.Metrics)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Increment indicates an expected call of Increment.
+func (mr *MockStoragerMockRecorder) Increment(ctx, name, delta interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Increment", reflect.TypeOf((*MockStorager)(nil).Increment), ctx, name, delta)
+}
+
 // Get mocks base method.
 func (m *MockStorager) Get(ctx context.Context, mType, name string) (models.Metrics, error) {
 	m.ctrl.T.Helper()
@@ -103,3 +119,17 @@ func (mr *MockStoragerMockRecorder) Ping(ctx context.Context) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ping", reflect.TypeOf((*MockStorager)(nil).Ping), ctx)
 }
+
+// Purge mocks base method.
+func (m *MockStorager) Purge(ctx context.Context, mType string, before time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Purge", ctx, mType, before)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Purge indicates an expected call of Purge.
+func (mr *MockStoragerMockRecorder) Purge(ctx, mType, before interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Purge", reflect.TypeOf((*MockStorager)(nil).Purge), ctx, mType, before)
+}
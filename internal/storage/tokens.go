@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/auth"
+	"github.com/dkrasnykh/metrics-alerter/internal/config"
+	"github.com/dkrasnykh/metrics-alerter/internal/repository"
+	"github.com/dkrasnykh/metrics-alerter/internal/storage/database"
+)
+
+// NewTokens returns nil when token authentication is disabled. A database
+// store shares the connections of r, or opens its own when r is nil.
+func NewTokens(c *config.ServerConfig, r repository.Storager) (auth.Store, error) {
+	switch c.TokenStore {
+	case ``:
+		return nil, nil
+	case `file`:
+		return auth.NewFileStore(c.TokensFile)
+	case `database`:
+		if c.DatabaseDSN == `` {
+			return nil, fmt.Errorf("token store %s requires DATABASE_DSN", c.TokenStore)
+		}
+		db, err := pool(c, r)
+		if err != nil {
+			return nil, err
+		}
+		return database.NewTokens(db, time.Duration(c.TokenCacheTTL)*time.Second), nil
+	default:
+		return nil, fmt.Errorf("unknown token store %s", c.TokenStore)
+	}
+}
+
+// pool returns the connection pool of the database storage r, so that the
+// stores kept in the database don't each open and migrate their own.
+func pool(c *config.ServerConfig, r repository.Storager) (*sqlx.DB, error) {
+	if w, ok := r.(*StorageWrap); ok {
+		r = w.r
+	}
+	if d, ok := r.(*database.Storage); ok {
+		return d.DB(), nil
+	}
+	return database.Open(c.DatabaseDSN)
+}
@@ -0,0 +1,359 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/storage/memory"
+	"github.com/dkrasnykh/metrics-alerter/internal/tenant"
+)
+
+const (
+	SyncAlways   = "always"
+	SyncInterval = "interval"
+	SyncNever    = "never"
+
+	logFile      = "metrics.wal"
+	snapshotFile = "metrics.snapshot"
+)
+
+const (
+	opCreate    = "create"
+	opIncrement = "increment"
+	opLoad      = "load"
+	opPurge     = "purge"
+)
+
+type record struct {
+	LSN     uint64           `json:"lsn"`
+	Op      string           `json:"op"`
+	Tenant  string           `json:"tenant,omitempty"`
+	Metrics []models.Metrics `json:"metrics,omitempty"`
+	MType   string           `json:"type,omitempty"`
+	Before  time.Time        `json:"before,omitempty"`
+	Time    time.Time        `json:"time"`
+}
+
+type snapshot struct {
+	LSN     uint64         `json:"lsn"`
+	Metrics []memory.Entry `json:"metrics"`
+}
+
+type Config struct {
+	Dir                string
+	Sync               string
+	SyncInterval       time.Duration
+	CheckpointInterval time.Duration
+}
+
+type Storage struct {
+	*memory.Storage
+	c    Config
+	file *os.File
+	size int64 // end of the last record written whole
+	lsn  uint64
+	mx   sync.Mutex
+	done chan struct{}
+}
+
+func New(c Config) (*Storage, error) {
+	switch c.Sync {
+	case SyncAlways, SyncInterval, SyncNever:
+	default:
+		return nil, fmt.Errorf("unknown wal sync policy %q", c.Sync)
+	}
+	err := os.MkdirAll(c.Dir, 0777)
+	if err != nil {
+		return nil, err
+	}
+	s := &Storage{
+		Storage: memory.New("", 0),
+		c:       c,
+		done:    make(chan struct{}),
+	}
+	err = s.restore()
+	if err != nil {
+		return nil, err
+	}
+	if c.Sync == SyncInterval && c.SyncInterval > 0 {
+		go s.every(c.SyncInterval, s.sync)
+	}
+	if c.CheckpointInterval > 0 {
+		go s.every(c.CheckpointInterval, s.Checkpoint)
+	}
+	return s, nil
+}
+
+func (s *Storage) Create(ctx context.Context, m models.Metrics) (models.Metrics, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	err := s.append(record{Op: opCreate, Tenant: tenant.ID(ctx), Metrics: []models.Metrics{m}})
+	if err != nil {
+		return models.Metrics{}, err
+	}
+	return s.Storage.Create(ctx, m)
+}
+
+func (s *Storage) Increment(ctx context.Context, name string, delta int64) (models.Metrics, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	m := models.Metrics{MType: models.CounterType, ID: name, Delta: &delta}
+	err := s.append(record{Op: opIncrement, Tenant: tenant.ID(ctx), Metrics: []models.Metrics{m}})
+	if err != nil {
+		return models.Metrics{}, err
+	}
+	return s.Storage.Increment(ctx, name, delta)
+}
+
+func (s *Storage) Load(ctx context.Context, metrics []models.Metrics) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	err := s.append(record{Op: opLoad, Tenant: tenant.ID(ctx), Metrics: metrics})
+	if err != nil {
+		return err
+	}
+	return s.Storage.Load(ctx, metrics)
+}
+
+func (s *Storage) Purge(ctx context.Context, mType string, before time.Time) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	err := s.append(record{Op: opPurge, MType: mType, Before: before})
+	if err != nil {
+		return err
+	}
+	return s.Storage.Purge(ctx, mType, before)
+}
+
+func (s *Storage) Ping(ctx context.Context) error {
+	return errors.New(`database is not used`)
+}
+
+func (s *Storage) Checkpoint() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	buf, err := json.Marshal(snapshot{LSN: s.lsn, Metrics: s.Storage.Dump()})
+	if err != nil {
+		return err
+	}
+	err = writeFile(filepath.Join(s.c.Dir, snapshotFile), buf)
+	if err != nil {
+		return err
+	}
+	s.size = 0
+	err = s.rewind()
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *Storage) Close() error {
+	close(s.done)
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	err := s.file.Sync()
+	if err != nil {
+		return err
+	}
+	return s.file.Close()
+}
+
+func (s *Storage) append(r record) error {
+	r.LSN = s.lsn + 1
+	r.Time = time.Now()
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	_, err = s.file.Write(buf)
+	if err == nil && s.c.Sync == SyncAlways {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		logger.LogErrorIfNotNil(s.rewind())
+		return fmt.Errorf("error writing wal record: %w", err)
+	}
+	s.size += int64(len(buf))
+	s.lsn = r.LSN
+	return nil
+}
+
+// rewind cuts the log back to its last whole record. A failed write must not
+// leave part of a record behind, or replay would stop there and drop every
+// record appended after it.
+func (s *Storage) rewind() error {
+	err := s.file.Truncate(s.size)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Seek(s.size, io.SeekStart)
+	return err
+}
+
+func (s *Storage) sync() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.file.Sync()
+}
+
+func (s *Storage) every(d time.Duration, f func() error) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			logger.LogErrorIfNotNil(f())
+		}
+	}
+}
+
+func (s *Storage) restore() error {
+	ctx := context.Background()
+	buf, err := os.ReadFile(filepath.Join(s.c.Dir, snapshotFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		var snap snapshot
+		err = json.Unmarshal(buf, &snap)
+		if err != nil {
+			return fmt.Errorf("error reading wal snapshot: %w", err)
+		}
+		s.Storage.Import(snap.Metrics)
+		s.lsn = snap.LSN
+	}
+
+	s.file, err = os.OpenFile(filepath.Join(s.c.Dir, logFile), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	valid, err := s.replay(ctx)
+	if err != nil {
+		return err
+	}
+	s.size = valid
+	return s.rewind()
+}
+
+// replay applies the log on top of the snapshot and returns the length of
+// its intact prefix; a torn record at the tail is dropped.
+func (s *Storage) replay(ctx context.Context) (int64, error) {
+	var valid int64
+	reader := bufio.NewReader(s.file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				logger.Error("dropping incomplete wal record")
+			}
+			return valid, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		var r record
+		err = json.Unmarshal(line, &r)
+		if err != nil {
+			logger.Error(fmt.Sprintf("dropping corrupt wal tail at offset %d: %s", valid, err.Error()))
+			return valid, nil
+		}
+		valid += int64(len(line))
+		if r.LSN <= s.lsn {
+			continue
+		}
+		err = s.apply(ctx, r)
+		if err != nil {
+			return 0, err
+		}
+		s.lsn = r.LSN
+	}
+}
+
+func (s *Storage) apply(ctx context.Context, r record) error {
+	ctx = tenant.WithID(ctx, r.Tenant)
+	var err error
+	switch r.Op {
+	case opCreate:
+		for _, m := range r.Metrics {
+			_, err = s.Storage.Create(ctx, m)
+		}
+	case opIncrement:
+		for _, m := range r.Metrics {
+			_, err = s.Storage.Increment(ctx, m.ID, *m.Delta)
+		}
+	case opLoad:
+		err = s.Storage.Load(ctx, r.Metrics)
+	case opPurge:
+		return s.Storage.Purge(ctx, r.MType, r.Before)
+	default:
+		return fmt.Errorf("unknown wal operation %q", r.Op)
+	}
+	// records written before they carried a time count as written now
+	if err == nil && !r.Time.IsZero() {
+		s.Storage.Touch(ctx, r.Metrics, r.Time)
+	}
+	return err
+}
+
+func writeFile(path string, buf []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(buf)
+	if err != nil {
+		logger.LogErrorIfNotNil(file.Close())
+		return err
+	}
+	err = file.Sync()
+	if err != nil {
+		logger.LogErrorIfNotNil(file.Close())
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+	// the rename must be durable before the log it replaces is truncated
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if err != nil {
+		logger.LogErrorIfNotNil(dir.Close())
+		return err
+	}
+	return dir.Close()
+}
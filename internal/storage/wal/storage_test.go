@@ -0,0 +1,173 @@
+package wal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dkrasnykh/metrics-alerter/internal/logger"
+	"github.com/dkrasnykh/metrics-alerter/internal/models"
+	"github.com/dkrasnykh/metrics-alerter/internal/tenant"
+)
+
+var (
+	mdelta = int64(500)
+	mvalue = float64(500)
+	mGauge = models.Metrics{MType: models.GaugeType, ID: "name1", Value: &mvalue}
+)
+
+func open(t *testing.T, dir string) *Storage {
+	s, err := New(Config{Dir: dir, Sync: SyncAlways})
+	require.NoError(t, err)
+	return s
+}
+
+func TestReplay(t *testing.T) {
+	_ = logger.InitLogger()
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s := open(t, dir)
+	_, err := s.Create(ctx, mGauge)
+	require.NoError(t, err)
+	_, err = s.Increment(tenant.WithID(ctx, "a"), "name1", 1)
+	require.NoError(t, err)
+	_, err = s.Increment(ctx, "name1", mdelta)
+	require.NoError(t, err)
+	err = s.Load(ctx, []models.Metrics{{MType: models.CounterType, ID: "name1", Delta: &mdelta}})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s = open(t, dir)
+	value, err := s.Get(ctx, models.CounterType, "name1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), *value.Delta)
+	value, err = s.Get(ctx, models.GaugeType, "name1")
+	require.NoError(t, err)
+	assert.Equal(t, mGauge, value)
+	value, err = s.Get(tenant.WithID(ctx, "a"), models.CounterType, "name1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), *value.Delta)
+	require.NoError(t, s.Checkpoint())
+	require.NoError(t, s.Close())
+
+	s = open(t, dir)
+	value, err = s.Get(tenant.WithID(ctx, "a"), models.CounterType, "name1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), *value.Delta)
+	require.NoError(t, s.Close())
+}
+
+func TestUpdatedSurvivesRestart(t *testing.T) {
+	_ = logger.InitLogger()
+	dir := t.TempDir()
+
+	s := open(t, dir)
+	_, err := s.Create(context.Background(), mGauge)
+	require.NoError(t, err)
+	updated := s.Dump()[0].Updated
+	require.NoError(t, s.Close())
+	time.Sleep(100 * time.Millisecond)
+
+	s = open(t, dir)
+	assert.WithinDuration(t, updated, s.Dump()[0].Updated, 10*time.Millisecond, "replayed from the log")
+	require.NoError(t, s.Checkpoint())
+	require.NoError(t, s.Close())
+
+	s = open(t, dir)
+	assert.WithinDuration(t, updated, s.Dump()[0].Updated, 10*time.Millisecond, "restored from the snapshot")
+	require.NoError(t, s.Close())
+}
+
+func TestCheckpoint(t *testing.T) {
+	_ = logger.InitLogger()
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s := open(t, dir)
+	_, err := s.Increment(ctx, "name1", mdelta)
+	require.NoError(t, err)
+	wal, err := os.ReadFile(filepath.Join(dir, logFile))
+	require.NoError(t, err)
+	require.NoError(t, s.Checkpoint())
+	info, err := os.Stat(filepath.Join(dir, logFile))
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+	_, err = s.Increment(ctx, "name1", mdelta)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// a crash between writing the snapshot and truncating the log leaves
+	// records already covered by the snapshot in front of the new ones
+	current, err := os.ReadFile(filepath.Join(dir, logFile))
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, logFile), append(wal, current...), 0666)
+	require.NoError(t, err)
+
+	s = open(t, dir)
+	value, err := s.Get(ctx, models.CounterType, "name1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), *value.Delta)
+	require.NoError(t, s.Close())
+}
+
+func TestTornTail(t *testing.T) {
+	_ = logger.InitLogger()
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s := open(t, dir)
+	_, err := s.Increment(ctx, "name1", mdelta)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_APPEND|os.O_WRONLY, 0666)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"lsn":2,"op":"incr`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s = open(t, dir)
+	_, err = s.Increment(ctx, "name1", mdelta)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s = open(t, dir)
+	value, err := s.Get(ctx, models.CounterType, "name1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), *value.Delta)
+	require.NoError(t, s.Close())
+}
+
+func TestRewind(t *testing.T) {
+	_ = logger.InitLogger()
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s := open(t, dir)
+	_, err := s.Increment(ctx, "name1", mdelta)
+	require.NoError(t, err)
+	// a write that failed part way, which append rewinds
+	_, err = s.file.WriteString(`{"lsn":2,"op":"incr`)
+	require.NoError(t, err)
+	require.NoError(t, s.rewind())
+	_, err = s.Increment(ctx, "name1", mdelta)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s = open(t, dir)
+	value, err := s.Get(ctx, models.CounterType, "name1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), *value.Delta, "records after the failed write are kept")
+	require.NoError(t, s.Close())
+}
+
+func TestUnknownSyncPolicy(t *testing.T) {
+	_, err := New(Config{Dir: t.TempDir(), Sync: "sometimes"})
+	assert.Error(t, err)
+}
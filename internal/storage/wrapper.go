@@ -2,6 +2,10 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
 
 	"github.com/avast/retry-go"
 
@@ -11,21 +15,68 @@ import (
 	"github.com/dkrasnykh/metrics-alerter/internal/repository"
 	"github.com/dkrasnykh/metrics-alerter/internal/storage/database"
 	"github.com/dkrasnykh/metrics-alerter/internal/storage/memory"
+	"github.com/dkrasnykh/metrics-alerter/internal/storage/wal"
 )
 
 type StorageWrap struct {
-	r repository.Storager
+	r    repository.Storager
+	stop context.CancelFunc
+	jobs sync.WaitGroup
 }
 
+// New returns a StorageWrap; Close it to stop its background jobs and
+// release the storage.
 func New(c *config.ServerConfig) (repository.Storager, error) {
 	var r repository.Storager
 	var err error
-	if c.DatabaseDSN == `` {
-		r = memory.New(c.FileStoragePath, c.StoreInterval)
+	ctx, stop := context.WithCancel(context.Background())
+	w := &StorageWrap{stop: stop}
+	switch {
+	case c.DatabaseDSN != ``:
+		err = retry.Do(
+			func() error {
+				d, err := database.New(c.DatabaseDSN)
+				if err != nil {
+					return err
+				}
+				d.SetTTL(c.TTL())
+				d.SetBatchSize(c.DBBatchSize)
+				w.jobs.Add(1)
+				go func() {
+					defer w.jobs.Done()
+					d.RunCompaction(ctx, database.Retention{
+						Raw:    time.Duration(c.RawRetention) * 24 * time.Hour,
+						Hourly: time.Duration(c.HourlyRetention) * 24 * time.Hour,
+					}, time.Duration(c.CompactInterval)*time.Second)
+				}()
+				r = d
+				return nil
+			},
+			retry.Attempts(config.Attempts),
+			retry.DelayType(config.DelayType),
+			retry.OnRetry(config.OnRetry),
+		)
+	case c.Storage == `wal`:
+		var w *wal.Storage
+		w, err = wal.New(wal.Config{
+			Dir:                c.WALDir,
+			Sync:               c.WALSync,
+			SyncInterval:       time.Duration(c.WALSyncInterval) * time.Second,
+			CheckpointInterval: time.Duration(c.CheckpointInterval) * time.Second,
+		})
+		if err == nil {
+			w.SetTTL(c.TTL())
+			r = w
+		}
+	default:
+		m := memory.NewSharded(c.FileStoragePath, c.StoreInterval, c.MemoryShards)
+		m.SetTTL(c.TTL())
+		m.SetSnapshotOptions(memory.SnapshotOptions{Compress: c.SnapshotGzip, Keep: c.SnapshotKeep})
+		r = m
 		if c.Restore {
 			err := retry.Do(
 				func() error {
-					err := memory.Restore(r, c.FileStoragePath)
+					err := memory.Restore(m, c.FileStoragePath)
 					return err
 				},
 				retry.Attempts(config.Attempts),
@@ -34,22 +85,24 @@ func New(c *config.ServerConfig) (repository.Storager, error) {
 			)
 			logger.LogErrorIfNotNil(err)
 		}
-	} else {
-		err = retry.Do(
-			func() error {
-				var err error
-				r, err = database.New(c.DatabaseDSN)
-				return err
-			},
-			retry.Attempts(config.Attempts),
-			retry.DelayType(config.DelayType),
-			retry.OnRetry(config.OnRetry),
-		)
 	}
 	if err != nil {
+		stop()
 		return nil, err
 	}
-	return &StorageWrap{r: r}, nil
+	w.r = r
+	return w, nil
+}
+
+// Close waits for the background jobs to stop and then closes the storage,
+// flushing what it holds in memory.
+func (s *StorageWrap) Close() error {
+	s.stop()
+	s.jobs.Wait()
+	if c, ok := s.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
 }
 
 func (s *StorageWrap) Create(ctx context.Context, metric models.Metrics) (models.Metrics, error) {
@@ -67,6 +120,11 @@ func (s *StorageWrap) Create(ctx context.Context, metric models.Metrics) (models
 	return m, err
 }
 
+func (s *StorageWrap) Increment(ctx context.Context, name string, delta int64) (models.Metrics, error) {
+	// not retried: a failed attempt may still have been applied
+	return s.r.Increment(ctx, name, delta)
+}
+
 func (s *StorageWrap) Get(ctx context.Context, mType, name string) (models.Metrics, error) {
 	var m models.Metrics
 	err := retry.Do(
@@ -78,6 +136,10 @@ func (s *StorageWrap) Get(ctx context.Context, mType, name string) (models.Metri
 		retry.Attempts(config.Attempts),
 		retry.DelayType(config.DelayType),
 		retry.OnRetry(config.OnRetry),
+		retry.RetryIf(func(err error) bool {
+			return !errors.Is(err, repository.ErrNotFound)
+		}),
+		retry.LastErrorOnly(true),
 	)
 	return m, err
 }
@@ -98,17 +160,41 @@ func (s *StorageWrap) GetAll(ctx context.Context) ([]models.Metrics, error) {
 }
 
 func (s *StorageWrap) Load(ctx context.Context, metrics []models.Metrics) error {
-	return retry.Do(
+	// not retried: counters are added to, and a failed attempt may still
+	// have been applied
+	return s.r.Load(ctx, metrics)
+}
+
+func (s *StorageWrap) History(ctx context.Context, mType, name string, from, to time.Time) ([]models.Point, error) {
+	h, ok := s.r.(repository.Historian)
+	if !ok {
+		return nil, repository.ErrNoHistory
+	}
+	var points []models.Point
+	err := retry.Do(
 		func() error {
-			err := s.r.Load(ctx, metrics)
+			var err error
+			points, err = h.History(ctx, mType, name, from, to)
 			return err
 		},
 		retry.Attempts(config.Attempts),
 		retry.DelayType(config.DelayType),
 		retry.OnRetry(config.OnRetry),
 	)
+	return points, err
 }
 
 func (s *StorageWrap) Ping(ctx context.Context) error {
 	return s.r.Ping(ctx)
 }
+
+func (s *StorageWrap) Purge(ctx context.Context, mType string, before time.Time) error {
+	return retry.Do(
+		func() error {
+			return s.r.Purge(ctx, mType, before)
+		},
+		retry.Attempts(config.Attempts),
+		retry.DelayType(config.DelayType),
+		retry.OnRetry(config.OnRetry),
+	)
+}
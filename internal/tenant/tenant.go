@@ -0,0 +1,103 @@
+package tenant
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const Header = "X-Tenant-ID"
+
+type Tenant struct {
+	ID    string `json:"id"`
+	Key   string `json:"key,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+type Registry struct {
+	byID    map[string]Tenant
+	byToken map[string]Tenant
+}
+
+type ctxKey struct{}
+
+func NewRegistry(tenants []Tenant) (*Registry, error) {
+	r := &Registry{
+		byID:    make(map[string]Tenant, len(tenants)),
+		byToken: make(map[string]Tenant, len(tenants)),
+	}
+	for _, t := range tenants {
+		if t.ID == "" {
+			return nil, errors.New("tenant id is empty")
+		}
+		if t.Key == "" && t.Token == "" {
+			return nil, fmt.Errorf("tenant %s has neither key nor token", t.ID)
+		}
+		if _, ok := r.byID[t.ID]; ok {
+			return nil, fmt.Errorf("duplicate tenant %s", t.ID)
+		}
+		r.byID[t.ID] = t
+		if t.Token != "" {
+			if _, ok := r.byToken[t.Token]; ok {
+				return nil, fmt.Errorf("tenant %s reuses a token", t.ID)
+			}
+			r.byToken[t.Token] = t
+		}
+	}
+	return r, nil
+}
+
+func Load(path string) (*Registry, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tenants from file %s: %w", path, err)
+	}
+	v := struct {
+		Tenants []Tenant `json:"tenants"`
+	}{}
+	err = json.Unmarshal(buf, &v)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing tenants file %s: %w", path, err)
+	}
+	return NewRegistry(v.Tenants)
+}
+
+func (r *Registry) ByID(id string) (Tenant, bool) {
+	t, ok := r.byID[id]
+	return t, ok
+}
+
+func (r *Registry) ByToken(token string) (Tenant, bool) {
+	t, ok := r.byToken[token]
+	return t, ok
+}
+
+func (r *Registry) IDs() []string {
+	ids := make([]string, 0, len(r.byID))
+	for id := range r.byID {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func NewContext(ctx context.Context, t Tenant) context.Context {
+	return context.WithValue(ctx, ctxKey{}, t)
+}
+
+func FromContext(ctx context.Context) (Tenant, bool) {
+	t, ok := ctx.Value(ctxKey{}).(Tenant)
+	return t, ok
+}
+
+// ID returns the tenant the context is scoped to; the empty ID is the
+// default namespace used when no tenants are configured.
+func ID(ctx context.Context) string {
+	t, _ := FromContext(ctx)
+	return t.ID
+}
+
+func WithID(ctx context.Context, id string) context.Context {
+	return NewContext(ctx, Tenant{ID: id})
+}
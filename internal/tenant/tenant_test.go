@@ -0,0 +1,50 @@
+package tenant
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	err := os.WriteFile(path, []byte(`{"tenants":[{"id":"a","key":"ka"},{"id":"b","token":"tb"}]}`), 0666)
+	require.NoError(t, err)
+
+	r, err := Load(path)
+	require.NoError(t, err)
+	a, ok := r.ByID("a")
+	assert.True(t, ok)
+	assert.Equal(t, "ka", a.Key)
+	b, ok := r.ByToken("tb")
+	assert.True(t, ok)
+	assert.Equal(t, "b", b.ID)
+	_, ok = r.ByToken("")
+	assert.False(t, ok)
+	assert.ElementsMatch(t, []string{"a", "b"}, r.IDs())
+}
+
+func TestNewRegistryInvalid(t *testing.T) {
+	_, err := NewRegistry([]Tenant{{ID: "a"}})
+	assert.Error(t, err)
+	_, err = NewRegistry([]Tenant{{ID: "a", Key: "k"}, {ID: "a", Key: "k"}})
+	assert.Error(t, err)
+	_, err = NewRegistry([]Tenant{{ID: "a", Token: "t"}, {ID: "b", Token: "t"}})
+	assert.Error(t, err)
+	_, err = NewRegistry([]Tenant{{Key: "k"}})
+	assert.Error(t, err)
+}
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, "", ID(ctx))
+	ctx = NewContext(ctx, Tenant{ID: "a", Key: "k"})
+	assert.Equal(t, "a", ID(ctx))
+	got, ok := FromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "k", got.Key)
+}